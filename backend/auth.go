@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// apiKeyAuth exige a chave configurada em API_KEY, enviada como
+// "Authorization: Bearer <chave>" ou no cabeçalho X-API-Key
+func apiKeyAuth(apiKey string) echo.MiddlewareFunc {
+	return middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		KeyLookup: "header:" + echo.HeaderAuthorization + ":Bearer ,header:X-API-Key",
+		Validator: func(key string, c echo.Context) (bool, error) {
+			// Comparação em tempo constante para não vazar a chave por timing
+			return subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1, nil
+		},
+		ErrorHandler: func(err error, c echo.Context) error {
+			requestLogger(c).Warn("Requisição sem chave de API válida", "error", err)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return respondError(c, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid API key")
+		},
+	})
+}
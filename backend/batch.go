@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+)
+
+// batchFileResult é o resultado da conversão de um arquivo do lote no report.json
+type batchFileResult struct {
+	File     string   `json:"file"`             // arquivo de origem, relativo ao arquivo compactado
+	Status   string   `json:"status"`           // "ok" ou "error"
+	Output   string   `json:"output,omitempty"` // arquivo gerado dentro do zip
+	Error    string   `json:"error,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Nome do relatório incluído no zip de um lote convertido com continueOnError
+const batchReportName = "report.json"
+
+// convertBatch converte cada arquivo markdown separadamente e empacota os resultados em um
+// zip em outputPath, preservando a estrutura de diretórios relativa a baseDir.
+// Os avisos do pandoc são prefixados com o arquivo que os gerou. Se progress não for nil,
+// é chamada após cada arquivo convertido com o total concluído até ali.
+// Por padrão a primeira falha interrompe o lote; com continueOnError os arquivos que falharem
+// são pulados e o zip inclui um report.json com o resultado de cada arquivo. Nesse modo o lote
+// só falha se nenhum arquivo puder ser convertido.
+func (s *server) convertBatch(ctx context.Context, logger *slog.Logger, mdFiles []string, baseDir, outputPath string, opts converter.Options, continueOnError bool, progress func(completed int, file string)) ([]string, error) {
+	outDir := filepath.Join(filepath.Dir(outputPath), "batch")
+
+	var warnings []string
+	var report []batchFileResult
+	var firstErr error
+
+	for i, mdFile := range mdFiles {
+		rel, err := filepath.Rel(baseDir, mdFile)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+
+		output := strings.TrimSuffix(rel, filepath.Ext(rel)) + opts.Format.Extension
+		target := filepath.Join(outDir, output)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+
+		fileWarnings, err := s.convertToDOCX(ctx, logger.With("file", rel), []string{mdFile}, target, opts)
+		if err != nil {
+			if !continueOnError {
+				return nil, err
+			}
+			logger.Warn("Arquivo do lote não convertido, seguindo com os demais", "file", rel, "error", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			result := batchFileResult{File: rel, Status: "error", Error: err.Error()}
+			var failure *converter.Failure
+			if errors.As(err, &failure) && failure.ExitCode > 0 {
+				result.ExitCode = failure.ExitCode
+			}
+			report = append(report, result)
+		} else {
+			report = append(report, batchFileResult{File: rel, Status: "ok", Output: output, Warnings: fileWarnings})
+		}
+		for _, warning := range fileWarnings {
+			warnings = append(warnings, rel+": "+warning)
+		}
+		if progress != nil {
+			progress(i+1, rel)
+		}
+	}
+
+	if continueOnError {
+		failed := 0
+		for _, result := range report {
+			if result.Status != "ok" {
+				failed++
+			}
+		}
+		if failed == len(report) {
+			return nil, fmt.Errorf("nenhum dos %d arquivos do lote foi convertido: %w", failed, firstErr)
+		}
+		if failed > 0 {
+			warnings = append(warnings, fmt.Sprintf("%d of %d files failed to convert, see %s", failed, len(report), batchReportName))
+		}
+
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(outDir, batchReportName), content, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return warnings, zipDirectory(outDir, outputPath)
+}
+
+// convertFormats converte os mesmos arquivos de origem uma vez para cada conjunto de opções,
+// em paralelo (limitado pelo semáforo de conversões), e empacota as saídas em um zip em
+// outputPath. Cada saída é nomeada a partir de source com a extensão do seu formato.
+func (s *server) convertFormats(ctx context.Context, logger *slog.Logger, mdFiles []string, source, outputPath string, targets []converter.Options) ([]string, error) {
+	outDir := filepath.Join(filepath.Dir(outputPath), "formats")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	warnings := make([][]string, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i, opts := range targets {
+		// Cada pandoc extrai as mídias no seu próprio diretório para não disputar os mesmos arquivos
+		opts.MediaDir = filepath.Join(opts.MediaDir, opts.Format.Writer)
+		target := filepath.Join(outDir, outputFilename(source, opts.Format))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			warnings[i], errs[i] = s.convertToDOCX(ctx, logger.With("target", opts.Format.Writer), mdFiles, target, opts)
+		}()
+	}
+	wg.Wait()
+
+	var all []string
+	for i, opts := range targets {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%s: %w", opts.Format.Writer, errs[i])
+		}
+		for _, warning := range warnings[i] {
+			all = append(all, opts.Format.Writer+": "+warning)
+		}
+	}
+
+	return all, zipDirectory(outDir, outputPath)
+}
+
+// convertBundle converte os arquivos de origem para HTML (ou markdown) extraindo as mídias ao lado
+// do documento e empacota os dois em um zip em outputPath. O pandoc referencia as mídias pelo caminho
+// absoluto passado em --extract-media, que é reescrito para o caminho relativo dentro do zip.
+// Com onlyWithMedia, se o pandoc não extraiu nenhuma mídia, outputPath recebe apenas o documento
+// (veja bundledOutput).
+func (s *server) convertBundle(ctx context.Context, logger *slog.Logger, mdFiles []string, source, outputPath string, opts converter.Options, onlyWithMedia bool) ([]string, error) {
+	outDir := filepath.Join(filepath.Dir(outputPath), "bundle")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	opts.MediaDir = filepath.Join(outDir, "media")
+	target := filepath.Join(outDir, outputFilename(source, opts.Format))
+	warnings, err := s.convertToDOCX(ctx, logger, mdFiles, target, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if onlyWithMedia {
+		media, err := os.ReadDir(opts.MediaDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if len(media) == 0 {
+			return warnings, os.Rename(target, outputPath)
+		}
+		logger.Info("Documento com mídias extraídas, enviando zip", "media", len(media))
+	}
+
+	content, err := os.ReadFile(target)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.ReplaceAll(content, []byte(outDir+string(os.PathSeparator)), nil)
+	if err := os.WriteFile(target, content, 0644); err != nil {
+		return nil, err
+	}
+
+	return warnings, zipDirectory(outDir, outputPath)
+}
+
+// bundledOutput ajusta o nome e o tipo de uma saída HTML ou markdown que convertBundle empacotou
+// em um zip junto com as mídias. Outras saídas são devolvidas sem alteração
+func bundledOutput(path, filename, contentType string) (string, string) {
+	if contentType != converter.OutputFormats["html"].ContentType && contentType != converter.OutputFormats["gfm"].ContentType {
+		return filename, contentType
+	}
+	if ok, _ := converter.IsZipFile(path); !ok {
+		return filename, contentType
+	}
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + archiveFormat.Extension, archiveFormat.ContentType
+}
+
+// zipDirectory cria em dst um zip com todos os arquivos de src, usando caminhos relativos a src
+func zipDirectory(src, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
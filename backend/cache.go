@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Tamanho máximo padrão do cache de conversões: 100MB
+const defaultCacheMaxBytes = 100 << 20
+
+// Cache das saídas de conversões recentes, configurável via CACHE_MAX_BYTES.
+// Fica nil (desativado) até ser criado na inicialização
+var conversionCache *outputCache
+
+// outputCache guarda em disco as saídas de conversões recentes, indexadas por um hash da
+// entrada e dos argumentos do pandoc, e descarta as menos usadas quando passa de maxBytes
+type outputCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	order    *list.List // entradas da mais recente para a menos recente
+}
+
+// cacheEntry é uma saída guardada no cache, junto com os avisos que o pandoc emitiu ao gerá-la
+type cacheEntry struct {
+	key      string
+	path     string
+	size     int64
+	warnings []string
+}
+
+// newOutputCache cria o cache em dir, descartando o que tiver sobrado de execuções anteriores
+func newOutputCache(dir string, maxBytes int64) (*outputCache, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &outputCache{dir: dir, maxBytes: maxBytes, entries: make(map[string]*list.Element), order: list.New()}, nil
+}
+
+// conversionCacheKey calcula a chave de cache de uma conversão: o hash do arquivo enviado, dos
+// arquivos de origem como o pandoc vai lê-los (já convertidos para UTF-8, a menos que a requisição
+// desligue a detecção), do documento de referência e dos argumentos do pandoc. Os caminhos do
+// diretório de trabalho são removidos dos argumentos para que a mesma conversão gere a mesma chave
+// em qualquer requisição
+func conversionCacheKey(upload *sourceUpload, referenceDoc string, args ...[]string) (string, error) {
+	h := sha256.New()
+	paths := append([]string{filepath.Join(upload.WorkDir, upload.Name)}, upload.Files...)
+	for _, path := range append(paths, referenceDoc) {
+		if path == "" {
+			continue
+		}
+		if err := hashFile(h, path); err != nil {
+			return "", err
+		}
+	}
+	for _, a := range args {
+		for _, arg := range a {
+			fmt.Fprintf(h, "%q\n", strings.ReplaceAll(arg, upload.WorkDir, ""))
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile escreve o conteúdo do arquivo no hash
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// contains informa se há uma saída guardada para a chave
+func (oc *outputCache) contains(key string) bool {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	_, ok := oc.entries[key]
+	return ok
+}
+
+// get copia para dest a saída guardada para a chave e retorna os avisos da conversão original
+func (oc *outputCache) get(key, dest string) ([]string, bool) {
+	oc.mu.Lock()
+	elem, ok := oc.entries[key]
+	if !ok {
+		oc.mu.Unlock()
+		return nil, false
+	}
+	oc.order.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	// Abrir ainda sob o lock: se a entrada for descartada durante a cópia, o arquivo aberto continua legível
+	f, err := os.Open(entry.path)
+	oc.mu.Unlock()
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return nil, false
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, f); err != nil {
+		return nil, false
+	}
+	return entry.warnings, true
+}
+
+// put guarda uma cópia de src no cache e descarta as entradas menos usadas até caber no limite
+func (oc *outputCache) put(key, src string, warnings []string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Size() > oc.maxBytes {
+		return nil
+	}
+
+	// Copiar para um arquivo temporário e renomear, para nunca expor uma saída incompleta
+	tmp, err := os.CreateTemp(oc.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	in, err := os.Open(src)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, in)
+	in.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+
+	if _, ok := oc.entries[key]; ok {
+		return nil
+	}
+	entry := &cacheEntry{key: key, path: filepath.Join(oc.dir, key), size: info.Size(), warnings: warnings}
+	if err := os.Rename(tmp.Name(), entry.path); err != nil {
+		return err
+	}
+	oc.entries[key] = oc.order.PushFront(entry)
+	oc.size += entry.size
+
+	for oc.size > oc.maxBytes {
+		oldest := oc.order.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		oc.order.Remove(oldest)
+		delete(oc.entries, evicted.key)
+		oc.size -= evicted.size
+		os.Remove(evicted.path)
+	}
+	return nil
+}
+
+// wrap envolve uma conversão que grava em outputPath: uma conversão idêntica já feita é
+// copiada do cache sem rodar o pandoc, e uma nova conversão bem-sucedida é guardada no cache
+func (oc *outputCache) wrap(logger *slog.Logger, key, outputPath string, convert func() ([]string, error)) func() ([]string, error) {
+	return func() ([]string, error) {
+		if warnings, ok := oc.get(key, outputPath); ok {
+			logger.Info("Saída obtida do cache", "cache_key", key)
+			cacheRequestsTotal.WithLabelValues("hit").Inc()
+			return warnings, nil
+		}
+		cacheRequestsTotal.WithLabelValues("miss").Inc()
+
+		warnings, err := convert()
+		if err != nil {
+			return warnings, err
+		}
+		if err := oc.put(key, outputPath, warnings); err != nil {
+			logger.Warn("Erro ao guardar saída no cache", "error", err)
+		}
+		return warnings, nil
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+)
+
+// cliOptions são os argumentos de uma conversão feita pela linha de comando, sem subir o servidor:
+//
+//	markdown-converter -in doc.md -out doc.docx [-to docx] [-from markdown]
+type cliOptions struct {
+	In   string // documento ou arquivo compactado (.zip, .tar.gz) a converter
+	Out  string // arquivo gerado
+	To   string // formato de saída; sem ele, deduzido da extensão de Out
+	From string // formato de entrada; sem ele, deduzido da extensão de In
+}
+
+// parseCLIFlags lê as flags da linha de comando. O segundo retorno é falso quando nem -in nem
+// -out foram informados, e então o servidor HTTP deve subir como de costume
+func parseCLIFlags(args []string, output io.Writer) (cliOptions, bool, error) {
+	var opts cliOptions
+	flags := flag.NewFlagSet("markdown-converter", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&opts.In, "in", "", "documento ou arquivo .zip/.tar.gz a converter")
+	flags.StringVar(&opts.Out, "out", "", "arquivo de saída")
+	flags.StringVar(&opts.To, "to", "", "formato de saída (docx, pdf, html, ...); padrão: extensão de -out")
+	flags.StringVar(&opts.From, "from", "", "formato de entrada (markdown, rst, ...); padrão: extensão de -in")
+	if err := flags.Parse(args); err != nil {
+		return opts, false, err
+	}
+	if opts.In == "" && opts.Out == "" {
+		return opts, false, nil
+	}
+	if opts.In == "" || opts.Out == "" {
+		return opts, true, errors.New("-in e -out devem ser informados juntos")
+	}
+	return opts, true, nil
+}
+
+// Formato escolhido para extensões compartilhadas por mais de um formato de saída (.md serve a
+// markdown e gfm); sem essa escolha, o resultado dependeria da ordem de iteração do mapa
+var cliExtensionFormats = map[string]string{".md": "markdown"}
+
+// cliOutputFormat resolve o formato de saída de -to ou, sem ele, pela extensão de -out
+func cliOutputFormat(opts cliOptions) (converter.OutputFormat, error) {
+	if opts.To != "" {
+		format, ok := converter.OutputFormats[opts.To]
+		if !ok {
+			return converter.OutputFormat{}, fmt.Errorf("formato de saída não suportado: %s", opts.To)
+		}
+		return format, nil
+	}
+	ext := strings.ToLower(filepath.Ext(opts.Out))
+	if name, ok := cliExtensionFormats[ext]; ok {
+		return converter.OutputFormats[name], nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(converter.OutputFormats)) {
+		if format := converter.OutputFormats[name]; format.Extension == ext {
+			return format, nil
+		}
+	}
+	return converter.OutputFormat{}, fmt.Errorf("não foi possível deduzir o formato de saída de %s; use -to", opts.Out)
+}
+
+// runCLI faz uma única conversão com as opções da linha de comando, reaproveitando
+// convertToDOCX, e retorna o código de saída do processo
+func runCLI(opts cliOptions) int {
+	if err := convertCLI(opts); err != nil {
+		fmt.Fprintln(os.Stderr, "erro:", err)
+		return 1
+	}
+	return 0
+}
+
+// convertCLI executa a conversão de runCLI, usando um diretório temporário para a extração
+func convertCLI(opts cliOptions) error {
+	logger := slog.Default().With("in", opts.In)
+
+	format, err := cliOutputFormat(opts)
+	if err != nil {
+		return err
+	}
+	if format.Writer == "pdf" && !pdfEngineAvailable {
+		return fmt.Errorf("engine de PDF %s não está instalado", pdfEngine)
+	}
+
+	from := converter.InputFormat{}
+	if opts.From != "" {
+		var ok bool
+		if from, ok = converter.InputFormatByReader(opts.From); !ok {
+			return fmt.Errorf("formato de entrada não suportado: %s", opts.From)
+		}
+	}
+
+	// O pandoc roda no diretório dos arquivos de origem, então os caminhos precisam ser absolutos
+	in, err := filepath.Abs(opts.In)
+	if err != nil {
+		return err
+	}
+	out, err := filepath.Abs(opts.Out)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp("", "markdown-converter-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	// Um arquivo compactado é extraído como no upload; um documento é convertido direto
+	var extractPath string
+	files := []string{in}
+	if converter.IsArchiveName(in) {
+		sourceFormats := converter.InputFormats
+		if from.Reader != "" {
+			sourceFormats = []converter.InputFormat{from}
+		}
+		extractPath = filepath.Join(workDir, "extracted")
+		if _, err := converter.ExtractArchive(logger, in, extractPath, extractLimits); err != nil {
+			return err
+		}
+		srcFile, detected, err := converter.FindSourceFile(extractPath, sourceFormats)
+		if err != nil {
+			return err
+		}
+		files, from = []string{srcFile}, detected
+	} else if from.Reader == "" {
+		var ok bool
+		if from, ok = converter.InputFormatForFile(in, converter.InputFormats); !ok {
+			return fmt.Errorf("não foi possível deduzir o formato de entrada de %s; use -from", opts.In)
+		}
+	}
+
+	// Os arquivos de origem passam pelas mesmas verificações do upload: limite de tamanho e
+	// conversão para UTF-8. Um documento informado diretamente é convertido em uma cópia em
+	// workDir, para que o arquivo de -in não seja alterado
+	if extractPath == "" {
+		if files[0], err = encodingCopy(in, workDir, from); err != nil {
+			return err
+		}
+	}
+	source := &sourceUpload{Name: filepath.Base(in), WorkDir: workDir, ExtractPath: extractPath, Files: files, From: from}
+	if err := source.checkSourceSizes(logger); err != nil {
+		return err
+	}
+	if err := source.normalizeEncoding(logger); err != nil {
+		return err
+	}
+
+	// Sem --extract-media: as mídias seriam extraídas no diretório temporário, removido ao final
+	convOpts := converter.Options{Format: format, From: from.Reader, TOCDepth: defaultTOCDepth}
+	convOpts, err = optionsForFormat(logger, convOpts, format, extractPath)
+	if err != nil {
+		return err
+	}
+
+	srv := &server{runner: converter.ExecRunner{Bin: pandocBin}}
+	warnings, err := srv.convertToDOCX(context.Background(), logger, files, out, convOpts)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "aviso:", warning)
+	}
+	return nil
+}
+
+// encodingCopy retorna path se o documento já estiver em UTF-8 (ou for binário, como um docx) e,
+// caso contrário, uma cópia em dir que normalizeEncoding pode reescrever sem alterar o original.
+// A cópia perde as imagens com caminho relativo, mas só é usada quando o pandoc não leria o original
+func encodingCopy(path, dir string, from converter.InputFormat) (string, error) {
+	if from.Binary {
+		return path, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if _, enc := converter.DetectEncoding(data); enc == nil {
+		return path, nil
+	}
+	dst := filepath.Join(dir, filepath.Base(path))
+	return dst, os.WriteFile(dst, data, 0644)
+}
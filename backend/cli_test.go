@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+)
+
+func TestParseCLIFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantCLI bool
+		wantErr bool
+	}{
+		{name: "sem flags sobe o servidor", args: nil},
+		{name: "-in e -out", args: []string{"-in", "doc.md", "-out", "doc.docx"}, wantCLI: true},
+		{name: "-in sem -out", args: []string{"-in", "doc.md"}, wantCLI: true, wantErr: true},
+		{name: "-out sem -in", args: []string{"-out", "doc.docx"}, wantCLI: true, wantErr: true},
+		{name: "flag desconhecida", args: []string{"-foo"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, cli, err := parseCLIFlags(tt.args, io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("erro = %v, esperado erro = %v", err, tt.wantErr)
+			}
+			if cli != tt.wantCLI {
+				t.Errorf("modo CLI = %v, esperado %v", cli, tt.wantCLI)
+			}
+		})
+	}
+}
+
+func TestCLIOutputFormat(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       cliOptions
+		wantWriter string
+		wantErr    bool
+	}{
+		{name: "-to explícito", opts: cliOptions{Out: "doc.bin", To: "pdf"}, wantWriter: "pdf"},
+		{name: "-to tem precedência sobre a extensão", opts: cliOptions{Out: "doc.docx", To: "html"}, wantWriter: "html"},
+		{name: "-to desconhecido", opts: cliOptions{Out: "doc.docx", To: "rtf"}, wantErr: true},
+		{name: "extensão em maiúsculas", opts: cliOptions{Out: "DOC.DOCX"}, wantWriter: "docx"},
+		{name: ".md de markdown e gfm", opts: cliOptions{Out: "x.md"}, wantWriter: "markdown"},
+		{name: "extensão desconhecida", opts: cliOptions{Out: "doc.xyz"}, wantErr: true},
+		{name: "sem extensão", opts: cliOptions{Out: "doc"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := cliOutputFormat(tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("erro = %v, esperado erro = %v", err, tt.wantErr)
+			}
+			if format.Writer != tt.wantWriter {
+				t.Errorf("formato = %q, esperado %q", format.Writer, tt.wantWriter)
+			}
+		})
+	}
+}
+
+func TestCLIOutputFormatInfersEveryExtension(t *testing.T) {
+	byExtension := make(map[string][]string)
+	for _, name := range slices.Sorted(maps.Keys(converter.OutputFormats)) {
+		ext := converter.OutputFormats[name].Extension
+		byExtension[ext] = append(byExtension[ext], name)
+	}
+
+	for ext, names := range byExtension {
+		t.Run(ext, func(t *testing.T) {
+			want := names[0]
+			// Uma extensão de vários formatos precisa de uma escolha explícita em cliExtensionFormats
+			if len(names) > 1 {
+				var ok bool
+				if want, ok = cliExtensionFormats[ext]; !ok {
+					t.Fatalf("extensão %s é usada por %v e não tem formato definido em cliExtensionFormats", ext, names)
+				}
+			}
+
+			// Repetir para que uma escolha dependente da ordem do mapa apareça
+			for range 20 {
+				format, err := cliOutputFormat(cliOptions{Out: "doc" + ext})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if format != converter.OutputFormats[want] {
+					t.Fatalf("formato de doc%s = %q, esperado %q", ext, format.Writer, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Respostas menores que isso não compensam a compressão
+const gzipMinLength = 1024
+
+// Tipos de conteúdo enviados sem gzip: formatos já compactados (docx, pdf, zip, imagens), em que
+// a compressão só gastaria CPU, e eventos SSE, que precisam chegar ao cliente assim que são escritos.
+// Entradas terminadas em "." ou "/" valem como prefixo
+var uncompressedTypes = []string{
+	"application/zip", "application/gzip", "application/pdf", "application/epub+zip",
+	"application/vnd.openxmlformats-officedocument.", "application/vnd.oasis.opendocument.",
+	"image/", "audio/", "video/", "text/event-stream",
+}
+
+// gzipMiddleware comprime com o middleware Gzip do echo as respostas de clientes que enviam
+// Accept-Encoding: gzip. Como o echo decide antes de o handler definir o Content-Type, cada
+// resposta passa por um selectiveWriter, que manda os tipos de uncompressedTypes (e o que já vem
+// comprimido, como o /metrics) direto para a conexão
+func gzipMiddleware() echo.MiddlewareFunc {
+	gzip := middleware.GzipWithConfig(middleware.GzipConfig{MinLength: gzipMinLength})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			original := c.Response().Writer
+			return gzip(func(c echo.Context) error {
+				// Sem Accept-Encoding: gzip o echo mantém o writer original
+				if res := c.Response(); res.Writer != original {
+					res.Writer = &selectiveWriter{plain: original, compressed: res.Writer}
+				}
+				return next(c)
+			})(c)
+		}
+	}
+}
+
+// selectiveWriter escolhe, pelos cabeçalhos da resposta, entre a conexão e o writer do gzip
+type selectiveWriter struct {
+	plain      http.ResponseWriter
+	compressed http.ResponseWriter
+	chosen     http.ResponseWriter
+}
+
+func (w *selectiveWriter) Header() http.Header {
+	return w.plain.Header()
+}
+
+func (w *selectiveWriter) WriteHeader(code int) {
+	w.choose().WriteHeader(code)
+}
+
+func (w *selectiveWriter) Write(b []byte) (int, error) {
+	return w.choose().Write(b)
+}
+
+func (w *selectiveWriter) Flush() {
+	_ = http.NewResponseController(w.choose()).Flush()
+}
+
+func (w *selectiveWriter) Unwrap() http.ResponseWriter {
+	return w.plain
+}
+
+// choose decide o destino na primeira escrita, quando o handler já definiu o Content-Type
+func (w *selectiveWriter) choose() http.ResponseWriter {
+	if w.chosen == nil {
+		w.chosen = w.compressed
+		if !compressible(w.plain.Header()) {
+			w.chosen = w.plain
+		}
+	}
+	return w.chosen
+}
+
+// compressible indica se uma resposta com estes cabeçalhos deve ser comprimida
+func compressible(header http.Header) bool {
+	if header.Get(echo.HeaderContentEncoding) != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get(echo.HeaderContentType))
+	if err != nil {
+		// Sem Content-Type o gzip do echo o detecta a partir do conteúdo
+		return true
+	}
+	for _, t := range uncompressedTypes {
+		if mediaType == t || (strings.HasSuffix(t, ".") || strings.HasSuffix(t, "/")) && strings.HasPrefix(mediaType, t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,410 @@
+package converter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Limits são as proteções aplicadas ao extrair um arquivo compactado contra zip bombs
+type Limits struct {
+	MaxBytes   int64 // total de bytes descompactados
+	MaxEntries int64 // quantidade de entradas do arquivo compactado
+
+	// Extensões que podem ser extraídas (.md, .png, .bib, ...), em minúsculas e com ponto.
+	// Vazia, qualquer extensão é aceita
+	AllowedExtensions []string
+}
+
+// DefaultLimits são os limites de extração padrão
+var DefaultLimits = Limits{MaxBytes: 200 << 20, MaxEntries: 1000}
+
+// Erros de extração que o chamador pode distinguir com errors.Is
+var (
+	// ErrNotAnArchive indica que o conteúdo do arquivo não é um zip nem um tar.gz
+	ErrNotAnArchive = errors.New("arquivo enviado não é um zip nem um tar.gz")
+
+	// ErrArchiveLimit indica que o arquivo compactado excedeu os limites de extração
+	ErrArchiveLimit = errors.New("arquivo compactado excede os limites de extração")
+
+	// ErrEmptyArchive indica que o arquivo compactado é válido, mas não tem nenhuma entrada
+	ErrEmptyArchive = errors.New("arquivo compactado vazio")
+
+	// ErrConflictingEntry indica um arquivo repetido ou um arquivo e um diretório com o mesmo caminho
+	ErrConflictingEntry = errors.New("entradas conflitantes no arquivo compactado")
+
+	// ErrEncryptedArchive indica um zip com entradas protegidas por senha, que a biblioteca padrão não lê
+	ErrEncryptedArchive = errors.New("arquivo compactado protegido por senha")
+)
+
+// Bit de propósito geral do cabeçalho zip que marca uma entrada criptografada
+const zipFlagEncrypted = 0x1
+
+// NormalizeExtensions converte uma lista de extensões para o formato de filepath.Ext: minúsculas e com ponto
+func NormalizeExtensions(exts []string) []string {
+	normalized := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+// Allows indica se uma entrada do arquivo compactado pode ser extraída
+func (l Limits) Allows(name string) bool {
+	if len(l.AllowedExtensions) == 0 {
+		return true
+	}
+	return slices.Contains(l.AllowedExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// EntryPath resolve o caminho de destino de uma entrada do arquivo compactado. O caminho é
+// normalizado antes da comparação com dest, para que entradas como ../../etc/x ou a/../../b,
+// que escapariam do diretório de destino, sejam rejeitadas
+func EntryPath(dest, name string) (string, error) {
+	dest = filepath.Clean(dest)
+	filePath := filepath.Clean(filepath.Join(dest, name))
+	if !strings.HasPrefix(filePath, dest+string(os.PathSeparator)) {
+		return "", fmt.Errorf("arquivo inválido detectado: %s", name)
+	}
+	return filePath, nil
+}
+
+// checkEntryConflict verifica se a entrada pode ser criada em filePath sem colidir com o que já
+// foi extraído em dest: um arquivo não pode repetir um caminho já extraído nem ocupar o lugar de
+// um diretório, e nenhum diretório do caminho pode já existir como arquivo. Entradas de diretório
+// repetidas são inofensivas e aceitas. Diretórios podem aparecer depois dos seus arquivos
+func checkEntryConflict(dest, filePath, name string, isDir bool) error {
+	// Os diretórios acima da entrada, do mais próximo de dest até o pai dela
+	rel, err := filepath.Rel(dest, filePath)
+	if err != nil {
+		return err
+	}
+	var parent string
+	for _, part := range strings.Split(filepath.Dir(rel), string(os.PathSeparator)) {
+		if part == "." {
+			break
+		}
+		parent = filepath.Join(parent, part)
+		if info, err := os.Lstat(filepath.Join(dest, parent)); err == nil && !info.IsDir() {
+			return fmt.Errorf("%w: %s é um arquivo, mas aparece como diretório em %s", ErrConflictingEntry, filepath.ToSlash(parent), name)
+		}
+	}
+
+	info, err := os.Lstat(filePath)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	case isDir && !info.IsDir():
+		return fmt.Errorf("%w: %s já foi extraído como arquivo", ErrConflictingEntry, name)
+	case !isDir && info.IsDir():
+		return fmt.Errorf("%w: %s já existe como diretório", ErrConflictingEntry, name)
+	case !isDir:
+		return fmt.Errorf("%w: %s aparece mais de uma vez", ErrConflictingEntry, name)
+	}
+	return nil
+}
+
+// Extensões dos arquivos compactados aceitos
+var ArchiveExtensions = []string{".zip", ".tar.gz", ".tgz"}
+
+// IsArchiveName indica, pela extensão, se o arquivo é um zip ou tar.gz
+func IsArchiveName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range ArchiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Assinaturas de um arquivo zip: cabeçalho local de arquivo e fim de diretório central (zip vazio)
+var zipSignatures = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+
+// IsZipFile verifica pelos primeiros bytes se o arquivo é um zip
+func IsZipFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, nil
+	}
+	for _, signature := range zipSignatures {
+		if bytes.Equal(header, signature) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Assinatura de um arquivo gzip
+var gzipSignature = []byte{0x1f, 0x8b}
+
+// IsGzipFile verifica pelos primeiros bytes se o arquivo é um gzip
+func IsGzipFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(header, gzipSignature), nil
+}
+
+// ExtractArchive identifica o tipo do arquivo compactado pelos primeiros bytes, e não pela
+// extensão, e o extrai em dest com Unzip ou UntarGz. Retorna quantos arquivos foram extraídos
+func ExtractArchive(logger *slog.Logger, src, dest string, limits Limits) (int, error) {
+	if ok, err := IsZipFile(src); err != nil {
+		return 0, err
+	} else if ok {
+		return Unzip(logger, src, dest, limits)
+	}
+
+	if ok, err := IsGzipFile(src); err != nil {
+		return 0, err
+	} else if ok {
+		return UntarGz(logger, src, dest, limits)
+	}
+	return 0, ErrNotAnArchive
+}
+
+// Unzip extrai um .zip em dest. Caminhos fora de dest são rejeitados, os limites de entradas
+// e de bytes descompactados são respeitados e links simbólicos são ignorados.
+// Retorna quantos arquivos foram extraídos
+func Unzip(logger *slog.Logger, src, dest string, limits Limits) (int, error) {
+	logger.Info("Iniciando extração do arquivo", "src", src, "dest", dest)
+
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		logger.Warn("Erro ao abrir o arquivo zip", "error", err)
+		return 0, err
+	}
+	defer r.Close()
+
+	if len(r.File) == 0 {
+		logger.Warn("Arquivo zip vazio")
+		return 0, ErrEmptyArchive
+	}
+	if int64(len(r.File)) > limits.MaxEntries {
+		return 0, fmt.Errorf("%w: %d entradas (máximo %d)", ErrArchiveLimit, len(r.File), limits.MaxEntries)
+	}
+	// Sem essa verificação, f.Open leria os bytes criptografados e falharia com um erro de checksum
+	for _, f := range r.File {
+		if f.Flags&zipFlagEncrypted != 0 {
+			logger.Warn("Arquivo zip protegido por senha", "entry", f.Name)
+			return 0, fmt.Errorf("%w: %s", ErrEncryptedArchive, f.Name)
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		logger.Error("Erro ao criar o diretório de destino", "error", err)
+		return 0, err
+	}
+
+	// Total de bytes descompactados e de arquivos extraídos até agora
+	var extracted int64
+	var files int
+
+	for _, f := range r.File {
+		logger.Debug("Extraindo", "entry", f.Name)
+
+		// Garantir que o caminho de destino esteja dentro do diretório de destino
+		filePath, err := EntryPath(dest, f.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := checkEntryConflict(dest, filePath, f.Name, f.FileInfo().IsDir()); err != nil {
+			logger.Warn("Entrada conflitante no arquivo zip", "entry", f.Name, "error", err)
+			return 0, err
+		}
+
+		if f.FileInfo().IsDir() {
+			logger.Debug("Criando diretório", "path", filePath)
+			os.MkdirAll(filePath, os.ModePerm)
+			continue
+		}
+
+		// Links simbólicos poderiam apontar para fora do diretório de trabalho
+		if f.Mode()&os.ModeSymlink != 0 {
+			logger.Warn("Ignorando link simbólico", "entry", f.Name)
+			continue
+		}
+		if !limits.Allows(f.Name) {
+			logger.Warn("Ignorando arquivo com extensão não permitida", "entry", f.Name)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+			logger.Error("Erro ao criar diretório para arquivo", "error", err)
+			return 0, err
+		}
+
+		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+		if err != nil {
+			logger.Error("Erro ao criar arquivo", "error", err)
+			return 0, err
+		}
+
+		srcFile, err := f.Open()
+		if err != nil {
+			logger.Warn("Erro ao abrir arquivo dentro do zip", "entry", f.Name, "error", err)
+			dstFile.Close()
+			return 0, err
+		}
+
+		// Copiar no máximo um byte além do limite restante para detectar o excesso
+		n, err := io.Copy(dstFile, io.LimitReader(srcFile, limits.MaxBytes-extracted+1))
+		srcFile.Close()
+		dstFile.Close()
+
+		if err != nil {
+			logger.Warn("Erro ao copiar conteúdo do arquivo", "entry", f.Name, "error", err)
+			return 0, err
+		}
+
+		extracted += n
+		if extracted > limits.MaxBytes {
+			return 0, fmt.Errorf("%w: conteúdo descompactado maior que %d bytes", ErrArchiveLimit, limits.MaxBytes)
+		}
+		files++
+	}
+
+	logger.Info("Extração concluída com sucesso", "entries", len(r.File), "files", files, "bytes", extracted)
+	return files, nil
+}
+
+// UntarGz extrai um .tar.gz com as mesmas proteções de Unzip: caminhos fora de dest são
+// rejeitados e os limites de entradas e de bytes descompactados são respeitados.
+// Links e arquivos especiais são ignorados.
+func UntarGz(logger *slog.Logger, src, dest string, limits Limits) (int, error) {
+	logger.Info("Iniciando extração do arquivo", "src", src, "dest", dest)
+
+	f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		logger.Warn("Erro ao abrir o arquivo gzip", "error", err)
+		return 0, err
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		logger.Error("Erro ao criar o diretório de destino", "error", err)
+		return 0, err
+	}
+
+	// Entradas, arquivos extraídos e bytes descompactados até agora
+	var entries, extracted int64
+	var files int
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.Warn("Erro ao ler o arquivo tar", "error", err)
+			return 0, err
+		}
+
+		entries++
+		if entries > limits.MaxEntries {
+			return 0, fmt.Errorf("%w: mais de %d entradas", ErrArchiveLimit, limits.MaxEntries)
+		}
+
+		logger.Debug("Extraindo", "entry", hdr.Name)
+
+		// Garantir que o caminho de destino esteja dentro do diretório de destino
+		filePath, err := EntryPath(dest, hdr.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
+			if err := checkEntryConflict(dest, filePath, hdr.Name, hdr.Typeflag == tar.TypeDir); err != nil {
+				logger.Warn("Entrada conflitante no arquivo tar", "entry", hdr.Name, "error", err)
+				return 0, err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(filePath, 0755); err != nil {
+				return 0, err
+			}
+			continue
+		case tar.TypeReg:
+		default:
+			// Links simbólicos e físicos poderiam apontar para fora do diretório de trabalho
+			logger.Warn("Ignorando entrada que não é arquivo nem diretório", "entry", hdr.Name, "type", string(hdr.Typeflag))
+			continue
+		}
+		if !limits.Allows(hdr.Name) {
+			logger.Warn("Ignorando arquivo com extensão não permitida", "entry", hdr.Name)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			logger.Error("Erro ao criar diretório para arquivo", "error", err)
+			return 0, err
+		}
+
+		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			logger.Error("Erro ao criar arquivo", "error", err)
+			return 0, err
+		}
+
+		// Copiar no máximo um byte além do limite restante para detectar o excesso
+		n, err := io.Copy(dstFile, io.LimitReader(tr, limits.MaxBytes-extracted+1))
+		dstFile.Close()
+
+		if err != nil {
+			logger.Warn("Erro ao copiar conteúdo do arquivo", "entry", hdr.Name, "error", err)
+			return 0, err
+		}
+
+		extracted += n
+		if extracted > limits.MaxBytes {
+			return 0, fmt.Errorf("%w: conteúdo descompactado maior que %d bytes", ErrArchiveLimit, limits.MaxBytes)
+		}
+		files++
+	}
+
+	if entries == 0 {
+		logger.Warn("Arquivo tar.gz vazio")
+		return 0, ErrEmptyArchive
+	}
+
+	logger.Info("Extração concluída com sucesso", "entries", entries, "files", files, "bytes", extracted)
+	return files, nil
+}
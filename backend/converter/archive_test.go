@@ -0,0 +1,272 @@
+package converter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Entradas maliciosas que tentam escrever fora do diretório de destino
+var traversalEntries = []string{"../../etc/x", "a/../../b", "../x", "a/b/../../../c"}
+
+func TestEntryPath(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "extracted")
+
+	tests := []struct {
+		name    string
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{name: "arquivo na raiz", entry: "doc.md", want: filepath.Join(dest, "doc.md")},
+		{name: "subdiretório", entry: "img/a.png", want: filepath.Join(dest, "img", "a.png")},
+		{name: ".. que permanece dentro", entry: "a/../b.md", want: filepath.Join(dest, "b.md")},
+		{name: "caminho absoluto", entry: "/etc/x", want: filepath.Join(dest, "etc", "x")},
+		{name: "../../etc/x", entry: "../../etc/x", wantErr: true},
+		{name: "a/../../b", entry: "a/../../b", wantErr: true},
+		{name: "../x", entry: "../x", wantErr: true},
+		{name: "prefixo do destino", entry: "../extracted-other/x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EntryPath(dest, tt.entry)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("EntryPath(%q) = %q, esperado erro", tt.entry, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EntryPath(%q): %v", tt.entry, err)
+			}
+			if got != tt.want {
+				t.Errorf("EntryPath(%q) = %q, esperado %q", tt.entry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnzipRejectsTraversal(t *testing.T) {
+	for _, entry := range traversalEntries {
+		t.Run(entry, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "docs.zip")
+			if err := os.WriteFile(src, zipArchive(t, map[string]string{entry: "malicioso"}), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(dir, "work", "extracted")
+			if _, err := Unzip(discardLogger(), src, dest, DefaultLimits); err == nil {
+				t.Fatal("esperado erro ao extrair entrada fora do destino")
+			}
+			assertNotWritten(t, dest, entry)
+		})
+	}
+}
+
+func TestUntarGzRejectsTraversal(t *testing.T) {
+	for _, entry := range traversalEntries {
+		t.Run(entry, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "docs.tar.gz")
+			if err := os.WriteFile(src, tarGzArchive(t, map[string]string{entry: "malicioso"}), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(dir, "work", "extracted")
+			if _, err := UntarGz(discardLogger(), src, dest, DefaultLimits); err == nil {
+				t.Fatal("esperado erro ao extrair entrada fora do destino")
+			}
+			assertNotWritten(t, dest, entry)
+		})
+	}
+}
+
+// Arquivos compactados malformados, com entradas em ordem; nomes terminados em / são diretórios
+var conflictingEntryTests = []struct {
+	name    string
+	entries []archiveEntry
+	wantErr bool
+}{
+	{name: "arquivo repetido", entries: []archiveEntry{{"a.md", "um"}, {"a.md", "dois"}}, wantErr: true},
+	{name: "arquivo e depois diretório", entries: []archiveEntry{{"docs", "x"}, {"docs/", ""}}, wantErr: true},
+	{name: "diretório e depois arquivo", entries: []archiveEntry{{"docs/", ""}, {"docs", "x"}}, wantErr: true},
+	{name: "arquivo usado como diretório", entries: []archiveEntry{{"docs", "x"}, {"docs/a.md", "y"}}, wantErr: true},
+	{name: "arquivo aninhado em arquivo", entries: []archiveEntry{{"a/b", "x"}, {"a/b/c.md", "y"}}, wantErr: true},
+	{name: "arquivo antes do diretório pai", entries: []archiveEntry{{"docs/a.md", "x"}, {"docs/", ""}}},
+	{name: "diretório repetido", entries: []archiveEntry{{"img/", ""}, {"img/", ""}, {"img/a.png", "x"}}},
+}
+
+func TestUnzipConflictingEntries(t *testing.T) {
+	for _, tt := range conflictingEntryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "docs.zip")
+			if err := os.WriteFile(src, zipEntries(t, tt.entries), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := Unzip(discardLogger(), src, filepath.Join(dir, "extracted"), DefaultLimits)
+			assertConflict(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestUntarGzConflictingEntries(t *testing.T) {
+	for _, tt := range conflictingEntryTests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "docs.tar.gz")
+			if err := os.WriteFile(src, tarGzEntries(t, tt.entries), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := UntarGz(discardLogger(), src, filepath.Join(dir, "extracted"), DefaultLimits)
+			assertConflict(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestUnzipRejectsEncryptedEntries(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if w, err := zw.Create("leia.md"); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.WriteString(w, "# aberto"); err != nil {
+		t.Fatal(err)
+	}
+	// Só o bit de criptografia importa: o conteúdo não precisa estar de fato criptografado
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "segredo.md", Method: zip.Deflate, Flags: 0x1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "# protegido"); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "docs.zip")
+	if err := os.WriteFile(src, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dir, "extracted")
+	if _, err := Unzip(discardLogger(), src, dest, DefaultLimits); !errors.Is(err, ErrEncryptedArchive) {
+		t.Fatalf("erro = %v, esperado ErrEncryptedArchive", err)
+	}
+	assertNotWritten(t, dest, "leia.md")
+}
+
+// assertConflict verifica se a extração falhou com ErrConflictingEntry quando esperado
+func assertConflict(t *testing.T, err error, wantErr bool) {
+	t.Helper()
+	if !wantErr {
+		if err != nil {
+			t.Fatalf("extração falhou: %v", err)
+		}
+		return
+	}
+	if !errors.Is(err, ErrConflictingEntry) {
+		t.Fatalf("erro = %v, esperado ErrConflictingEntry", err)
+	}
+}
+
+// assertNotWritten verifica que a entrada não foi gravada no caminho para onde ela apontava
+func assertNotWritten(t *testing.T, dest, entry string) {
+	t.Helper()
+	target := filepath.Join(dest, entry)
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("a entrada %q foi gravada em %s", entry, target)
+	}
+}
+
+// archiveEntry é uma entrada de um arquivo compactado montado nos testes
+type archiveEntry struct {
+	name    string
+	content string
+}
+
+// entriesOf converte um mapa nome -> conteúdo em entradas
+func entriesOf(files map[string]string) []archiveEntry {
+	var entries []archiveEntry
+	for name, content := range files {
+		entries = append(entries, archiveEntry{name, content})
+	}
+	return entries
+}
+
+// zipArchive monta em memória um zip com os arquivos informados (nome -> conteúdo)
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	return zipEntries(t, entriesOf(files))
+}
+
+// zipEntries monta em memória um zip com as entradas na ordem informada, sem impedir repetições
+func zipEntries(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarGzArchive monta em memória um tar.gz com os arquivos informados (nome -> conteúdo)
+func tarGzArchive(t *testing.T, files map[string]string) []byte {
+	return tarGzEntries(t, entriesOf(files))
+}
+
+// tarGzEntries monta em memória um tar.gz com as entradas na ordem informada; nomes terminados
+// em / viram entradas de diretório
+func tarGzEntries(t *testing.T, entries []archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		name, content := entry.name, entry.content
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// discardLogger descarta os logs gerados durante o teste
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,72 @@
+package converter
+
+import (
+	"bytes"
+	"os"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// BOM do UTF-8, que o pandoc trataria como parte do texto
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// DetectEncoding identifica a codificação de um texto pelo BOM ou, sem ele, pelo conteúdo:
+// UTF-16 quando metade dos bytes é zero (texto ASCII em UTF-16), UTF-8 quando a sequência é
+// válida e Windows-1252, superconjunto do Latin-1, nos demais casos. Retorna o nome da
+// codificação e o decodificador, nil quando o texto já é UTF-8 sem BOM
+func DetectEncoding(data []byte) (string, encoding.Encoding) {
+	switch {
+	case bytes.HasPrefix(data, utf8BOM):
+		return "UTF-8 com BOM", unicode.UTF8BOM
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "UTF-16LE", unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return "UTF-16BE", unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	}
+
+	if len(data) >= 2 && len(data)%2 == 0 {
+		var evenZeros, oddZeros int
+		for i := 0; i < len(data); i += 2 {
+			if data[i] == 0 {
+				evenZeros++
+			}
+			if data[i+1] == 0 {
+				oddZeros++
+			}
+		}
+		half := len(data) / 4
+		switch {
+		case oddZeros > half && evenZeros == 0:
+			return "UTF-16LE", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+		case evenZeros > half && oddZeros == 0:
+			return "UTF-16BE", unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+		}
+	}
+
+	if utf8.Valid(data) {
+		return "UTF-8", nil
+	}
+	return "Windows-1252", charmap.Windows1252
+}
+
+// NormalizeEncoding reescreve o arquivo em UTF-8 sem BOM, como o pandoc espera, quando ele
+// estiver em outra codificação. Retorna a codificação detectada e se o arquivo foi convertido
+func NormalizeEncoding(path string) (string, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	name, enc := DetectEncoding(data)
+	if enc == nil {
+		return name, false, nil
+	}
+	converted, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return name, false, err
+	}
+	return name, true, os.WriteFile(path, converted, 0644)
+}
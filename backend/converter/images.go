@@ -0,0 +1,99 @@
+package converter
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Referências a imagens locais: ![alt](caminho "título") do markdown e <img src="caminho"> do HTML
+var (
+	markdownImagePattern = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?([^)\s>]+)>?`)
+	htmlImagePattern     = regexp.MustCompile(`(?i)<img\s[^>]*?src\s*=\s*["']([^"']+)["']`)
+)
+
+// ImageReferences lista, sem repetições, os caminhos locais de imagens referenciados no
+// documento, ignorando URLs remotas, data URIs e blocos de código cercados
+func ImageReferences(content []byte) []string {
+	var refs []string
+	var fence string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			continue
+		}
+
+		for _, pattern := range []*regexp.Regexp{markdownImagePattern, htmlImagePattern} {
+			for _, match := range pattern.FindAllStringSubmatch(line, -1) {
+				if ref, ok := localImagePath(match[1]); ok && !slices.Contains(refs, ref) {
+					refs = append(refs, ref)
+				}
+			}
+		}
+	}
+	return refs
+}
+
+// localImagePath normaliza a referência de uma imagem local, sem âncora nem query string.
+// Retorna falso para URLs com esquema (http:, data:) ou sem host (//cdn)
+func localImagePath(ref string) (string, bool) {
+	if strings.HasPrefix(ref, "//") {
+		return "", false
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Scheme != "" || u.Path == "" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// MissingImages retorna as imagens referenciadas nos arquivos de origem que não existem. Cada
+// referência é resolvida a partir do diretório do arquivo que a contém e só pode apontar para
+// dentro de root; caminhos absolutos ou que saem de root contam como ausentes sem consultar o
+// disco, para não revelar arquivos do servidor
+func MissingImages(root string, files []string) ([]string, error) {
+	var missing []string
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range ImageReferences(content) {
+			if slices.Contains(missing, ref) {
+				continue
+			}
+			if !imageExists(root, filepath.Dir(file), ref) {
+				missing = append(missing, ref)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// imageExists indica se a referência, resolvida a partir de dir, é um arquivo dentro de root
+func imageExists(root, dir, ref string) bool {
+	if filepath.IsAbs(ref) || strings.HasPrefix(ref, "/") {
+		return false
+	}
+	path := filepath.Join(dir, filepath.FromSlash(ref))
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,51 @@
+package converter
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMissingImages(t *testing.T) {
+	root := t.TempDir()
+	docs := filepath.Join(root, "docs")
+	if err := os.MkdirAll(filepath.Join(docs, "img"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(docs, "img", "ok.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := filepath.Join(docs, "doc.md")
+	content := "# Doc\n\n" +
+		"![ok](img/ok.png \"título\") ![âncora](img/ok.png#x)\n" +
+		"![falta](img/falta.png)\n" +
+		"<img src=\"img/tambem%20falta.png\">\n" +
+		"![remota](https://example.com/a.png) ![inline](data:image/png;base64,AAAA)\n" +
+		"![fora](../../etc/passwd) ![absoluta](/etc/hostname)\n" +
+		"```\n![em código](img/ignorada.png)\n```\n"
+	if err := os.WriteFile(doc, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := MissingImages(docs, []string{doc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"img/falta.png", "img/tambem falta.png", "../../etc/passwd", "/etc/hostname"}
+	if !slices.Equal(missing, want) {
+		t.Errorf("MissingImages() = %q, esperado %q", missing, want)
+	}
+
+	// Um arquivo fora de root conta como ausente, mesmo existindo no disco
+	if err := os.WriteFile(doc, []byte("![x](../secret.png)\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if missing, _ := MissingImages(docs, []string{doc}); !slices.Equal(missing, []string{"../secret.png"}) {
+		t.Errorf("MissingImages() = %q, esperado a imagem fora do workspace", missing)
+	}
+}
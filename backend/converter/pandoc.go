@@ -0,0 +1,484 @@
+// Package converter converte documentos com o pandoc: extrai arquivos compactados enviados,
+// localiza os arquivos de origem e executa o pandoc com as opções de cada conversão.
+package converter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OutputFormat descreve um formato de saída suportado pela conversão
+type OutputFormat struct {
+	Label       string // nome legível exibido aos usuários
+	Writer      string // writer do pandoc passado em -t
+	Extension   string // extensão do arquivo gerado
+	ContentType string // tipo MIME do arquivo gerado
+	Streamable  bool   // o pandoc consegue escrever este formato em stdout
+
+	// Saída em texto (markdown): as imagens continuam referenciadas pelos caminhos originais,
+	// sem --extract-media, que os trocaria pelos caminhos do diretório de trabalho. A exceção é uma
+	// entrada binária (docx), cujas imagens só existem dentro do documento
+	Text bool
+}
+
+// Formatos de saída suportados, indexados pelo nome aceito na API
+var OutputFormats = map[string]OutputFormat{
+	"docx":     {Label: "Microsoft Word", Writer: "docx", Extension: ".docx", ContentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", Streamable: true},
+	"pdf":      {Label: "PDF", Writer: "pdf", Extension: ".pdf", ContentType: "application/pdf"},
+	"html":     {Label: "HTML", Writer: "html", Extension: ".html", ContentType: "text/html; charset=utf-8", Streamable: true},
+	"odt":      {Label: "OpenDocument Text", Writer: "odt", Extension: ".odt", ContentType: "application/vnd.oasis.opendocument.text", Streamable: true},
+	"epub":     {Label: "EPUB", Writer: "epub", Extension: ".epub", ContentType: "application/epub+zip", Streamable: true},
+	"latex":    {Label: "LaTeX", Writer: "latex", Extension: ".tex", ContentType: "application/x-latex", Streamable: true},
+	"markdown": {Label: "Markdown (pandoc)", Writer: "markdown", Extension: ".md", ContentType: "text/markdown; charset=utf-8", Streamable: true, Text: true},
+	"gfm":      {Label: "GitHub Flavored Markdown", Writer: "gfm", Extension: ".md", ContentType: "text/markdown; charset=utf-8", Streamable: true, Text: true},
+	"pptx":     {Label: "Microsoft PowerPoint", Writer: "pptx", Extension: ".pptx", ContentType: "application/vnd.openxmlformats-officedocument.presentationml.presentation", Streamable: true},
+}
+
+// Options reúne as opções de uma conversão repassadas ao pandoc
+type Options struct {
+	Format         OutputFormat
+	From           string // reader do pandoc (-f); markdown quando vazio
+	Dialect        string // variante de markdown com extensões (gfm, markdown+smart), usada como -f quando From é markdown
+	ReferenceDoc   string // reference.docx ou reference.pptx com os estilos do documento gerado
+	TOC            bool   // gerar sumário (--toc)
+	TOCDepth       int    // níveis de título incluídos no sumário (--toc-depth)
+	NumberSections bool   // numerar os títulos (--number-sections); o sumário herda a numeração
+	Standalone     bool   // HTML autocontido, com as imagens embutidas (--embed-resources)
+	MediaDir       string // diretório onde o pandoc extrai as mídias (--extract-media)
+	NoExtractMedia bool   // omitir --extract-media, para documentos só com imagens remotas
+	Template       string // template do pandoc (--template)
+	Highlight      string // estilo de destaque dos blocos de código (--highlight-style); "none" desativa o destaque
+	Math           string // renderizador das fórmulas no HTML (--mathjax, --katex, --mathml); vazio usa mathjax
+
+	// Bibliografia (.bib) e estilo de citação (.csl) para processar citações com --citeproc
+	Bibliography string
+	CSL          string
+
+	// Capa (--epub-cover-image) e metadados Dublin Core (--epub-metadata) de um EPUB
+	EpubCover    string
+	EpubMetadata string
+
+	// Metadados do documento (campos de MetadataFields) passados com --metadata.
+	// Valores da linha de comando têm precedência sobre o front matter YAML do markdown.
+	Metadata map[string]string
+
+	// Variáveis dos templates do pandoc (fontsize, geometry, mainfont, ...) passadas com --variable;
+	// valide-as com CheckVariable
+	Variables map[string]string
+}
+
+// Campos de metadados repassados ao pandoc, na ordem em que entram na linha de comando
+var MetadataFields = []string{"title", "author", "date"}
+
+// Estilos de destaque de código embutidos no pandoc (pandoc --list-highlight-styles)
+var HighlightStyles = []string{"pygments", "tango", "espresso", "zenburn", "kate", "monochrome", "breezedark", "haddock"}
+
+// Renderizadores de fórmulas LaTeX aceitos em Options.Math; o primeiro é o padrão do HTML
+var MathRenderers = []string{"mathjax", "katex", "mathml"}
+
+// ParseMathRenderer valida um renderizador de fórmulas de MathRenderers
+func ParseMathRenderer(value string) (string, error) {
+	if !slices.Contains(MathRenderers, value) {
+		return "", fmt.Errorf("unsupported math renderer %q (expected one of %s)", value, strings.Join(MathRenderers, ", "))
+	}
+	return value, nil
+}
+
+// Quantidade máxima de variáveis de template por conversão e tamanho máximo de cada valor
+const (
+	MaxVariables      = 32
+	maxVariableLength = 256
+)
+
+// Nomes válidos de variáveis de template, como fontsize ou header-color
+var variableKeyPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// Valores aceitos nas variáveis: letras, dígitos, espaços e pontuação de medidas e listas. Barras
+// invertidas, chaves e $ ficam de fora porque o pandoc insere o valor sem escape no template,
+// onde viraria código LaTeX ou HTML
+var variableValuePattern = regexp.MustCompile(`^[\pL\pN .,:;=/+()_-]*$`)
+
+// Variáveis que inserem conteúdo bruto no documento e, por isso, não podem vir da requisição
+var unsafeVariables = []string{"header-includes", "include-before", "include-after"}
+
+// CheckVariable valida uma variável de template antes de ela virar um --variable
+func CheckVariable(key, value string) error {
+	if !variableKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid variable name %q: use letters, digits, - and _", key)
+	}
+	if slices.Contains(unsafeVariables, key) {
+		return fmt.Errorf("variable %q is not allowed", key)
+	}
+	if len(value) > maxVariableLength {
+		return fmt.Errorf("value of variable %q is longer than %d characters", key, maxVariableLength)
+	}
+	if !variableValuePattern.MatchString(value) {
+		return fmt.Errorf("value of variable %q has unsupported characters: use letters, digits, spaces and .,:;=/+()_-", key)
+	}
+	return nil
+}
+
+// Valor de Options.Highlight que desativa o destaque de código (--no-highlight)
+const NoHighlight = "none"
+
+// ParseHighlightStyle valida um estilo de destaque de código: um de HighlightStyles ou NoHighlight
+func ParseHighlightStyle(value string) (string, error) {
+	if value != NoHighlight && !slices.Contains(HighlightStyles, value) {
+		return "", fmt.Errorf("unsupported highlight style %q (expected one of %s or %s)", value, strings.Join(HighlightStyles, ", "), NoHighlight)
+	}
+	return value, nil
+}
+
+// Runner executa o pandoc com os argumentos informados, usando dir como diretório atual.
+// Quando ctx termina (timeout ou cancelamento) o processo deve ser encerrado.
+// Os testes substituem o Runner para não depender do pandoc instalado.
+type Runner interface {
+	Run(ctx context.Context, dir string, args []string, stdout, stderr io.Writer) error
+}
+
+// ExitError indica que o pandoc rodou, mas terminou com código de saída diferente de zero
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "exit status " + strconv.Itoa(e.Code)
+}
+
+// ExitCode retorna o código de saída do pandoc correspondente ao erro de Run, ou -1 se o
+// processo nem chegou a terminar normalmente
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return -1
+}
+
+// ExecRunner roda o executável do pandoc em Bin
+type ExecRunner struct {
+	Bin string
+}
+
+func (r ExecRunner) Run(ctx context.Context, dir string, args []string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, r.Bin, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Não esperar indefinidamente pelos pipes caso o pandoc tenha deixado processos filhos
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return &ExitError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// ErrTimeout indica que o pandoc excedeu o tempo limite e foi encerrado
+var ErrTimeout = errors.New("pandoc excedeu o tempo limite")
+
+// Failure é a falha de uma execução do pandoc. ExitCode é -1 quando o pandoc nem
+// chegou a rodar (executável ausente, sem permissão), o que o diferencia de uma entrada inválida
+type Failure struct {
+	ExitCode int
+	Output   string // saída de erro do pandoc
+	Err      error
+}
+
+func (e *Failure) Error() string {
+	return fmt.Sprintf("pandoc error: %v, output: %s", e.Err, e.Output)
+}
+
+func (e *Failure) Unwrap() error {
+	return e.Err
+}
+
+// Posição de um erro de sintaxe na saída do pandoc, como em
+// Error parsing YAML metadata at "doc.md" (line 3, column 1) ou YAML parse exception at line 2, column 5
+var sourceLocationPattern = regexp.MustCompile(`\bline (\d+), column (\d+)`)
+
+// Location retorna a linha e a coluna do arquivo de origem em que o pandoc encontrou um erro de
+// sintaxe, quando a saída de erro as informa
+func (e *Failure) Location() (line, column int, ok bool) {
+	match := sourceLocationPattern.FindStringSubmatch(e.Output)
+	if match == nil {
+		return 0, 0, false
+	}
+	line, _ = strconv.Atoi(match[1])
+	column, _ = strconv.Atoi(match[2])
+	return line, column, true
+}
+
+// Pandoc executa conversões com a configuração compartilhada por todas elas
+type Pandoc struct {
+	Runner       Runner
+	PDFEngine    string        // engine usado para gerar PDF (--pdf-engine)
+	PDFFallbacks []string      // engines tentados, em ordem, quando PDFEngine falha
+	Filters      []string      // filtros aplicados a todas as conversões; arquivos .lua usam --lua-filter
+	Defaults     string        // arquivo de defaults (--defaults), sobrescrito pelas opções de cada conversão
+	Timeout      time.Duration // tempo máximo de cada execução; zero não limita
+}
+
+// Códigos de saída do pandoc para falhas do engine de PDF: erro ao gerar o PDF e engine não encontrado
+const (
+	exitPDFError          = 43
+	exitPDFEngineNotFound = 47
+)
+
+// PDFEngineFailed indica se a conversão falhou por causa do engine de PDF, e não do documento
+func PDFEngineFailed(err error) bool {
+	var failure *Failure
+	return errors.As(err, &failure) && (failure.ExitCode == exitPDFError || failure.ExitCode == exitPDFEngineNotFound)
+}
+
+// Run executa o pandoc no diretório do primeiro arquivo de origem, para que caminhos
+// relativos como ./images/foo.png sejam resolvidos a partir dele, independentemente de onde
+// o processo foi iniciado
+func (p *Pandoc) Run(ctx context.Context, files []string, args []string, stdout, stderr io.Writer) error {
+	return p.Runner.Run(ctx, filepath.Dir(files[0]), args, stdout, stderr)
+}
+
+// WithTimeout deriva de ctx o contexto de uma execução, limitado por Timeout
+func (p *Pandoc) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+// Error descreve a falha de uma execução do pandoc feita com ctx, distinguindo o estouro do
+// tempo limite (ErrTimeout) de uma Failure
+func (p *Pandoc) Error(ctx context.Context, err error, output []byte) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w (%s)", ErrTimeout, p.Timeout)
+	}
+	return &Failure{ExitCode: ExitCode(err), Output: string(output), Err: err}
+}
+
+// ErrUnsafeOption indica uma opção com valor que o pandoc poderia interpretar como outra flag
+var ErrUnsafeOption = errors.New("opção com valor inseguro")
+
+// Validate rejeita opções que chegariam ao pandoc como flags: valores que começam com "-" e
+// variáveis de template fora do formato aceito por CheckVariable. Os handlers já validam cada
+// parâmetro contra a lista de valores aceitos; esta é a última barreira antes do pandoc
+func (o Options) Validate() error {
+	values := []struct{ name, value string }{
+		{"from", o.From}, {"dialect", o.Dialect}, {"format", o.Format.Writer},
+		{"highlight", o.Highlight}, {"math", o.Math},
+	}
+	for _, v := range values {
+		if strings.HasPrefix(v.value, "-") {
+			return fmt.Errorf("%w: %s=%q", ErrUnsafeOption, v.name, v.value)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(o.Variables)) {
+		if err := CheckVariable(key, o.Variables[key]); err != nil {
+			return fmt.Errorf("%w: %w", ErrUnsafeOption, err)
+		}
+	}
+	return nil
+}
+
+// Convert executa o pandoc sobre os arquivos de origem informados, gravando o resultado em outputPath.
+// Quando há mais de um arquivo, o pandoc os concatena em um único documento. Se o engine de PDF
+// falhar, os de PDFFallbacks são tentados em ordem até um deles gerar o arquivo.
+// Retorna os avisos que o pandoc escreveu em stderr, uma linha por aviso.
+func (p *Pandoc) Convert(ctx context.Context, logger *slog.Logger, files []string, outputPath string, opts Options) ([]string, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	warnings, err := p.convert(ctx, logger, files, outputPath, opts)
+	if opts.Format.Writer != "pdf" {
+		return warnings, err
+	}
+
+	engine := p.PDFEngine
+	for _, fallback := range p.PDFFallbacks {
+		if !PDFEngineFailed(err) {
+			break
+		}
+		logger.Warn("Engine de PDF falhou, tentando o próximo", "engine", engine, "next", fallback, "error", err)
+		next := *p
+		next.PDFEngine = fallback
+		engine = fallback
+		warnings, err = next.convert(ctx, logger, files, outputPath, opts)
+	}
+	if err == nil && engine != p.PDFEngine {
+		logger.Info("PDF gerado com engine alternativo", "engine", engine)
+	}
+	return warnings, err
+}
+
+// convert executa uma vez o pandoc com a configuração de p
+func (p *Pandoc) convert(ctx context.Context, logger *slog.Logger, files []string, outputPath string, opts Options) ([]string, error) {
+	ctx, cancel := p.WithTimeout(ctx)
+	defer cancel()
+
+	start := time.Now()
+	var stdout, stderr bytes.Buffer
+	err := p.Run(ctx, files, p.Args(files, outputPath, opts), &stdout, &stderr)
+	logger.Info("Pandoc finalizado", "exit_code", ExitCode(err), "duration_ms", time.Since(start).Milliseconds())
+	if err != nil {
+		return nil, p.Error(ctx, err, stderr.Bytes())
+	}
+
+	// Avisos como imagens ausentes ou citações não resolvidas não impedem a conversão, mas não devem ser descartados
+	warnings := Warnings(stderr.String())
+	if len(warnings) > 0 {
+		logger.Warn("Avisos do pandoc", "warnings", warnings)
+	}
+	return warnings, nil
+}
+
+// Warnings separa a saída de stderr do pandoc em uma lista de avisos, um por linha
+func Warnings(stderr string) []string {
+	var warnings []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			warnings = append(warnings, line)
+		}
+	}
+	return warnings
+}
+
+// Args monta os argumentos do pandoc. Use "-" como outputPath para escrever em stdout.
+func (p *Pandoc) Args(files []string, outputPath string, opts Options) []string {
+	from := opts.From
+	if from == "" {
+		from = "markdown"
+	}
+	if opts.Dialect != "" && from == "markdown" {
+		from = opts.Dialect
+	}
+	// O arquivo de defaults vem primeiro: o pandoc deixa as opções seguintes sobrescreverem as dele
+	var args []string
+	if p.Defaults != "" {
+		args = append(args, "--defaults="+p.Defaults)
+	}
+	// Valores que vêm da requisição sempre entram grudados na flag (--from=gfm), nunca como um
+	// argumento separado que o pandoc poderia ler como outra flag; veja também Options.Validate
+	args = append(args, "--from="+from)
+	if opts.Format.Writer == "pdf" {
+		// Para PDF o pandoc escolhe o writer intermediário (latex, html, ...) compatível com o engine
+		args = append(args, "--pdf-engine="+p.PDFEngine)
+	} else {
+		args = append(args, "--to="+opts.Format.Writer)
+	}
+	for _, file := range files {
+		args = append(args, pathArg(file))
+	}
+	if outputPath != "-" {
+		outputPath = pathArg(outputPath)
+	}
+	args = append(args, "-o", outputPath)
+	if opts.MediaDir != "" && (!opts.Format.Text || binaryReader(opts.From)) && !opts.NoExtractMedia {
+		args = append(args, "--extract-media="+opts.MediaDir)
+	}
+	if opts.ReferenceDoc != "" {
+		args = append(args, "--reference-doc="+opts.ReferenceDoc)
+	}
+	if opts.TOC {
+		args = append(args, "--toc", "--toc-depth="+strconv.Itoa(opts.TOCDepth))
+	}
+	if opts.NumberSections {
+		args = append(args, "--number-sections")
+	}
+	switch opts.Highlight {
+	case "":
+	case NoHighlight:
+		args = append(args, "--no-highlight")
+	default:
+		args = append(args, "--highlight-style="+opts.Highlight)
+	}
+	if opts.Format.Writer == "html" {
+		// Só o HTML precisa de um renderizador de fórmulas; DOCX e PDF têm matemática nativa
+		math := opts.Math
+		if math == "" {
+			math = MathRenderers[0]
+		}
+		args = append(args, "--"+math)
+	}
+	if opts.Template != "" {
+		args = append(args, "--template="+opts.Template)
+	}
+	if opts.EpubCover != "" {
+		args = append(args, "--epub-cover-image="+opts.EpubCover)
+	}
+	if opts.EpubMetadata != "" {
+		args = append(args, "--epub-metadata="+opts.EpubMetadata)
+	}
+	if opts.Standalone || opts.Template != "" {
+		// Sem --standalone o pandoc gera apenas um fragmento e ignora o template
+		args = append(args, "--standalone")
+	}
+	if opts.Standalone {
+		// As imagens são lidas para serem embutidas; ao mesclar, os arquivos de origem podem
+		// estar em pastas diferentes, então todas entram no caminho de busca
+		args = append(args, "--embed-resources", "--resource-path="+resourcePath(files))
+	}
+	// Os filtros vêm antes do --citeproc porque o pandoc os aplica na ordem da linha de comando
+	for _, filter := range p.Filters {
+		if strings.HasSuffix(filter, ".lua") {
+			args = append(args, "--lua-filter="+filter)
+		} else {
+			args = append(args, "--filter="+filter)
+		}
+	}
+	if opts.Bibliography != "" {
+		args = append(args, "--citeproc", "--bibliography="+opts.Bibliography)
+		if opts.CSL != "" {
+			args = append(args, "--csl="+opts.CSL)
+		}
+	}
+	for _, field := range MetadataFields {
+		if value, ok := opts.Metadata[field]; ok {
+			args = append(args, "--metadata="+field+"="+value)
+		}
+	}
+	// Em ordem alfabética, para que a mesma requisição gere sempre os mesmos argumentos
+	for _, key := range slices.Sorted(maps.Keys(opts.Variables)) {
+		args = append(args, "--variable="+key+"="+opts.Variables[key])
+	}
+	return args
+}
+
+// pathArg protege um caminho passado como argumento solto: começando com "-", o pandoc o
+// leria como uma flag
+func pathArg(path string) string {
+	if strings.HasPrefix(path, "-") {
+		return "." + string(filepath.Separator) + path
+	}
+	return path
+}
+
+// resourcePath monta o --resource-path com os diretórios dos arquivos de origem, sem repetições
+func resourcePath(files []string) string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return strings.Join(dirs, string(os.PathListSeparator))
+}
@@ -0,0 +1,112 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Valor usado nas tentativas de injeção: se virasse um argumento solto, o pandoc rodaria o filtro
+const injectedFlag = "--lua-filter=/tmp/evil.lua"
+
+// recordingRunner registra os argumentos de cada execução sem rodar o pandoc
+type recordingRunner struct {
+	calls [][]string
+}
+
+func (r *recordingRunner) Run(ctx context.Context, dir string, args []string, stdout, stderr io.Writer) error {
+	r.calls = append(r.calls, args)
+	return nil
+}
+
+func TestOptionsValidateRejectsInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "from", opts: Options{From: injectedFlag}},
+		{name: "dialect", opts: Options{Dialect: injectedFlag}},
+		{name: "format", opts: Options{Format: OutputFormat{Writer: injectedFlag}}},
+		{name: "highlight", opts: Options{Highlight: injectedFlag}},
+		{name: "math", opts: Options{Math: injectedFlag}},
+		{name: "nome de variável", opts: Options{Variables: map[string]string{injectedFlag: "x"}}},
+		{name: "valor de variável com LaTeX", opts: Options{Variables: map[string]string{"mainfont": `\input{/etc/passwd}`}}},
+		{name: "variável com conteúdo bruto", opts: Options{Variables: map[string]string{"header-includes": "x"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); !errors.Is(err, ErrUnsafeOption) {
+				t.Errorf("Validate() = %v, esperado ErrUnsafeOption", err)
+			}
+		})
+	}
+
+	valid := Options{From: "markdown", Dialect: "gfm+smart", Format: OutputFormats["html"], Highlight: "kate", Math: "katex",
+		Variables: map[string]string{"geometry": "margin=1in", "fontsize": "12pt", "indent": "-1cm"}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Validate() de opções válidas = %v", err)
+	}
+}
+
+func TestArgsKeepValuesAttachedToFlags(t *testing.T) {
+	p := &Pandoc{PDFEngine: "pdflatex"}
+	opts := Options{
+		Format:    OutputFormats["docx"],
+		Dialect:   "gfm",
+		Metadata:  map[string]string{"title": injectedFlag},
+		Variables: map[string]string{"indent": injectedFlag},
+	}
+
+	args := p.Args([]string{"-doc.md", "/work/b.md"}, "-out.docx", opts)
+
+	if slices.Contains(args, injectedFlag) {
+		t.Fatalf("valor da requisição virou um argumento solto: %q", args)
+	}
+	for _, want := range []string{"--from=gfm", "--to=docx", "--metadata=title=" + injectedFlag, "--variable=indent=" + injectedFlag} {
+		if !slices.Contains(args, want) {
+			t.Errorf("argumento %q ausente em %q", want, args)
+		}
+	}
+	// Caminhos que começam com "-" não podem ser lidos como flags
+	for _, want := range []string{"./-doc.md", "/work/b.md", "./-out.docx"} {
+		if !slices.Contains(args, want) {
+			t.Errorf("caminho %q ausente em %q", want, args)
+		}
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && arg != "-o" {
+			t.Errorf("argumento inesperado %q em %q", arg, args)
+		}
+	}
+}
+
+func TestConvertRejectsUnsafeOptions(t *testing.T) {
+	runner := &recordingRunner{}
+	p := &Pandoc{Runner: runner}
+	opts := Options{Format: OutputFormats["docx"], Highlight: injectedFlag}
+
+	_, err := p.Convert(context.Background(), discardLogger(), []string{"/work/doc.md"}, "/work/out.docx", opts)
+	if !errors.Is(err, ErrUnsafeOption) {
+		t.Fatalf("Convert() = %v, esperado ErrUnsafeOption", err)
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("o pandoc não deveria ter sido executado: %q", runner.calls)
+	}
+}
+
+func TestArgsExtractMediaFromDocx(t *testing.T) {
+	p := &Pandoc{}
+	opts := Options{Format: OutputFormats["gfm"], MediaDir: "/work/media"}
+
+	if args := p.Args([]string{"/work/doc.md"}, "/work/out.md", opts); slices.Contains(args, "--extract-media=/work/media") {
+		t.Errorf("markdown para markdown não deveria extrair mídias: %q", args)
+	}
+	opts.From = "docx"
+	if args := p.Args([]string{"/work/doc.docx"}, "/work/out.md", opts); !slices.Contains(args, "--extract-media=/work/media") {
+		t.Errorf("as imagens do docx deveriam ser extraídas: %q", args)
+	}
+}
@@ -0,0 +1,300 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// InputFormat descreve um formato de entrada lido pelo pandoc
+type InputFormat struct {
+	Reader     string   // reader do pandoc passado em -f
+	Extensions []string // extensões reconhecidas, em minúsculas
+	Binary     bool     // formato binário, lido sem conversão de codificação
+}
+
+// Extensões reconhecidas como markdown
+var MarkdownExtensions = []string{".md", ".markdown", ".mdown", ".mkd"}
+
+// Formatos de entrada suportados. A ordem define a prioridade ao procurar o arquivo de
+// origem dentro de um arquivo compactado
+var InputFormats = []InputFormat{
+	{Reader: "markdown", Extensions: MarkdownExtensions},
+	{Reader: "rst", Extensions: []string{".rst"}},
+	{Reader: "textile", Extensions: []string{".textile"}},
+	{Reader: "html", Extensions: []string{".html", ".htm"}},
+	{Reader: "org", Extensions: []string{".org"}},
+	{Reader: "latex", Extensions: []string{".tex"}},
+	{Reader: "docx", Extensions: []string{".docx"}, Binary: true},
+}
+
+// Variantes de markdown aceitas como dialeto, cada uma um reader do pandoc
+var MarkdownDialects = []string{"markdown", "gfm", "commonmark", "commonmark_x", "markdown_strict", "markdown_phpextra", "markdown_mmd"}
+
+// Extensões do pandoc que um dialeto pode ligar (+) ou desligar (-)
+var DialectExtensions = []string{
+	"auto_identifiers", "autolink_bare_uris", "citations", "definition_lists", "emoji",
+	"east_asian_line_breaks", "fenced_divs", "bracketed_spans", "footnotes", "grid_tables",
+	"hard_line_breaks", "implicit_figures", "pipe_tables", "raw_html", "raw_tex", "smart",
+	"strikeout", "subscript", "superscript", "task_lists", "tex_math_dollars", "yaml_metadata_block",
+}
+
+// ParseDialect valida um dialeto de markdown no formato aceito pelo -f do pandoc: uma variante de
+// MarkdownDialects seguida de extensões de DialectExtensions, como gfm ou markdown+smart-raw_html
+func ParseDialect(value string) (string, error) {
+	end := strings.IndexAny(value, "+-")
+	if end < 0 {
+		end = len(value)
+	}
+	if base := value[:end]; !slices.Contains(MarkdownDialects, base) {
+		return "", fmt.Errorf("unsupported dialect %q (expected one of %s)", base, strings.Join(MarkdownDialects, ", "))
+	}
+
+	for rest := value[end:]; rest != ""; {
+		// Cada extensão vai do sinal até o próximo + ou -
+		next := strings.IndexAny(rest[1:], "+-")
+		if next < 0 {
+			next = len(rest) - 1
+		}
+		extension := rest[1 : next+1]
+		if !slices.Contains(DialectExtensions, extension) {
+			return "", fmt.Errorf("unsupported dialect extension %q", extension)
+		}
+		rest = rest[next+1:]
+	}
+	return value, nil
+}
+
+// InputFormatByReader retorna o formato de entrada com o reader informado
+func InputFormatByReader(reader string) (InputFormat, bool) {
+	for _, format := range InputFormats {
+		if format.Reader == reader {
+			return format, true
+		}
+	}
+	return InputFormat{}, false
+}
+
+// binaryReader indica se o reader lê um formato binário, como docx
+func binaryReader(reader string) bool {
+	format, ok := InputFormatByReader(reader)
+	return ok && format.Binary
+}
+
+// InputFormatForFile identifica, pela extensão, qual dos formatos informados corresponde ao arquivo
+func InputFormatForFile(path string, formats []InputFormat) (InputFormat, bool) {
+	if i := formatIndex(path, formats); i < len(formats) {
+		return formats[i], true
+	}
+	return InputFormat{}, false
+}
+
+// formatIndex retorna a posição em formats do formato do arquivo, ou len(formats) se nenhum corresponder
+func formatIndex(path string, formats []InputFormat) int {
+	ext := strings.ToLower(filepath.Ext(path))
+	for i, format := range formats {
+		for _, candidate := range format.Extensions {
+			if ext == candidate {
+				return i
+			}
+		}
+	}
+	return len(formats)
+}
+
+// InputExtensions lista as extensões aceitas pelos formatos informados
+func InputExtensions(formats []InputFormat) []string {
+	var exts []string
+	for _, format := range formats {
+		exts = append(exts, format.Extensions...)
+	}
+	return exts
+}
+
+// errStopWalk é retornado pelas funções de filepath.WalkDir para encerrar a busca assim que
+// o arquivo procurado é encontrado; não é um erro de verdade e nunca chega ao chamador
+var errStopWalk = errors.New("busca encerrada")
+
+// FindSourceFile procura em dir o arquivo de origem a converter. Entre os formatos informados,
+// vence o que aparece primeiro na lista; dentro do mesmo formato, o primeiro arquivo encontrado
+func FindSourceFile(dir string, formats []InputFormat) (string, InputFormat, error) {
+	var srcFile string
+	var others []string
+	best := len(formats)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		others = append(others, path)
+		if i := formatIndex(path, formats); i < best {
+			srcFile, best = path, i
+			if best == 0 {
+				return errStopWalk
+			}
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return "", InputFormat{}, fmt.Errorf("error walking the path %s: %v", dir, err)
+	}
+
+	if srcFile == "" {
+		return "", InputFormat{}, sourceNotFoundError(dir, formats, others)
+	}
+
+	return srcFile, formats[best], nil
+}
+
+// ErrMainFileNotFound indica que o arquivo de origem escolhido pelo nome não existe no diretório
+var ErrMainFileNotFound = errors.New("arquivo principal não encontrado no arquivo compactado")
+
+// FindMainFile localiza o arquivo de origem name, um caminho relativo a dir. O formato vem da
+// extensão, entre os formatos informados; com um único formato (?from=), qualquer extensão é aceita
+func FindMainFile(dir, name string, formats []InputFormat) (string, InputFormat, error) {
+	path, err := EntryPath(dir, filepath.FromSlash(name))
+	if err != nil {
+		return "", InputFormat{}, fmt.Errorf("%w: %s", ErrMainFileNotFound, name)
+	}
+	if info, err := os.Lstat(path); err != nil || !info.Mode().IsRegular() {
+		return "", InputFormat{}, fmt.Errorf("%w: %s", ErrMainFileNotFound, name)
+	}
+
+	if format, ok := InputFormatForFile(path, formats); ok {
+		return path, format, nil
+	}
+	if len(formats) == 1 {
+		return path, formats[0], nil
+	}
+	return "", InputFormat{}, fmt.Errorf("unsupported source file %s (expected one of %s)", name, strings.Join(InputExtensions(formats), ", "))
+}
+
+// FindSourceFiles retorna todos os arquivos de origem do diretório, ordenados pelo nome do arquivo.
+// Como o pandoc lê um único formato por execução, só os arquivos do formato de maior prioridade são usados
+func FindSourceFiles(dir string, formats []InputFormat) ([]string, InputFormat, error) {
+	byFormat := make([][]string, len(formats))
+	var others []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if i := formatIndex(path, formats); i < len(formats) {
+			byFormat[i] = append(byFormat[i], path)
+		} else {
+			others = append(others, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, InputFormat{}, fmt.Errorf("error walking the path %s: %v", dir, err)
+	}
+
+	for i, srcFiles := range byFormat {
+		if len(srcFiles) == 0 {
+			continue
+		}
+
+		// Ordenar pelo nome do arquivo (01.md, 02.md, ...), desempatando pelo caminho completo
+		sort.Slice(srcFiles, func(a, b int) bool {
+			ba, bb := filepath.Base(srcFiles[a]), filepath.Base(srcFiles[b])
+			if ba != bb {
+				return ba < bb
+			}
+			return srcFiles[a] < srcFiles[b]
+		})
+		return srcFiles, formats[i], nil
+	}
+
+	return nil, InputFormat{}, sourceNotFoundError(dir, formats, others)
+}
+
+// Quantidade máxima de arquivos do zip listados na mensagem de erro
+const maxListedFiles = 10
+
+// sourceNotFoundError descreve a ausência de arquivos de origem, listando as extensões aceitas
+// e alguns dos arquivos que o zip continha, para deixar claro quando o zip errado foi enviado
+func sourceNotFoundError(dir string, formats []InputFormat, files []string) error {
+	msg := fmt.Sprintf("no source file found (expected one of %s)", strings.Join(InputExtensions(formats), ", "))
+	if len(files) == 0 {
+		return errors.New(msg + "; archive is empty")
+	}
+
+	listed := make([]string, 0, maxListedFiles)
+	for _, file := range files[:min(len(files), maxListedFiles)] {
+		if rel, err := filepath.Rel(dir, file); err == nil {
+			file = filepath.ToSlash(rel)
+		}
+		listed = append(listed, file)
+	}
+	msg += "; archive contained: " + strings.Join(listed, ", ")
+	if len(files) > maxListedFiles {
+		msg += fmt.Sprintf(" and %d more", len(files)-maxListedFiles)
+	}
+	return errors.New(msg)
+}
+
+// FindNamedFile procura no diretório um arquivo com o nome informado, ignorando maiúsculas
+func FindNamedFile(dir, name string) (string, error) {
+	var found string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(d.Name(), name) {
+			found = path
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return "", err
+	}
+	return found, nil
+}
+
+// FindFileWithExt procura no diretório o primeiro arquivo com a extensão informada, ignorando maiúsculas
+func FindFileWithExt(dir, ext string) (string, error) {
+	var found string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ext) {
+			found = path
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopWalk) {
+		return "", err
+	}
+	return found, nil
+}
+
+// SaveUploadedFile grava em dst o arquivo recebido em um formulário multipart
+func SaveUploadedFile(file *multipart.FileHeader, dst string) error {
+	src, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, src)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Espaço livre mínimo padrão no diretório de uploads: 100MB
+const defaultMinFreeDiskBytes = 100 << 20
+
+// Quantas vezes o tamanho do upload precisa estar livre: o arquivo enviado, o conteúdo
+// extraído e a saída gerada ocupam o disco ao mesmo tempo
+const defaultDiskSpaceMultiplier = 3
+
+// Limites da verificação de espaço, configuráveis via MIN_FREE_DISK_BYTES e DISK_SPACE_MULTIPLIER
+var (
+	minFreeDiskBytes    uint64 = defaultMinFreeDiskBytes
+	diskSpaceMultiplier uint64 = defaultDiskSpaceMultiplier
+)
+
+// checkDiskSpace verifica, antes de receber o upload, se há espaço livre em uploadsDir para
+// uploadSize bytes. uploadSize negativo (tamanho desconhecido) considera apenas o mínimo configurado.
+// Falhas ao consultar o sistema de arquivos não bloqueiam a requisição
+func checkDiskSpace(logger *slog.Logger, uploadSize int64) error {
+	free, err := freeDiskSpace(uploadsDir)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			logger.Warn("Erro ao consultar espaço livre em disco", "dir", uploadsDir, "error", err)
+		}
+		return nil
+	}
+
+	required := minFreeDiskBytes
+	if uploadSize > 0 {
+		required = max(required, uint64(uploadSize)*diskSpaceMultiplier)
+	}
+	if free < required {
+		logger.Error("Espaço em disco insuficiente", "dir", uploadsDir, "free", free, "required", required)
+		return newAPIError(http.StatusInsufficientStorage, codeInsufficientStorage, "Insufficient storage to process the upload",
+			fmt.Sprintf("%d bytes free, %d bytes required", free, required))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIError é o formato padrão das respostas de erro da API.
+// Code é um identificador estável que os clientes podem usar para distinguir os erros.
+// Status só é usado quando o APIError circula como error até o handler.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  string `json:"detail,omitempty"`
+
+	// Código de saída do pandoc, quando ele rodou e falhou
+	ExitCode int `json:"exit_code,omitempty"`
+
+	// Posição no arquivo de origem de um erro de sintaxe relatado pelo pandoc
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+}
+
+// Códigos de erro retornados pela API
+const (
+	codeInvalidFormat       = "invalid_format"
+	codeInvalidInputFormat  = "invalid_input_format"
+	codeInvalidParameter    = "invalid_parameter"
+	codeNoFile              = "no_file"
+	codeInvalidFilename     = "invalid_filename"
+	codeFileTooLarge        = "file_too_large"
+	codeSourceTooLarge      = "source_too_large"
+	codeUnsupportedFile     = "unsupported_file_type"
+	codeInvalidEncoding     = "invalid_encoding"
+	codeStorageFailed       = "storage_failed"
+	codeInsufficientStorage = "insufficient_storage"
+	codeNotAZip             = "not_a_zip"
+	codeArchiveTooLarge     = "archive_too_large"
+	codeEmptyArchive        = "empty_archive"
+	codeInvalidArchive      = "invalid_archive"
+	codeEncryptedArchive    = "encrypted_archive"
+	codeExtractFailed       = "extract_failed"
+	codeMarkdownNotFound    = "markdown_not_found"
+	codeMainFileNotFound    = "main_file_not_found"
+	codeConversionFailed    = "conversion_failed"
+	codeParseError          = "parse_error"
+	codeConversionTimeout   = "conversion_timeout"
+	codeRequestTimeout      = "request_timeout"
+	codePandocUnavailable   = "pandoc_unavailable"
+	codePDFEngineMissing    = "pdf_engine_unavailable"
+	codeInvalidReference    = "invalid_reference_doc"
+	codeInvalidTemplate     = "invalid_template"
+	codeServerBusy          = "server_busy"
+	codeQueueFull           = "queue_full"
+	codeJobNotFound         = "job_not_found"
+	codeJobNotReady         = "job_not_ready"
+	codeUnauthorized        = "unauthorized"
+	codeRateLimited         = "rate_limited"
+	codeInvalidURL          = "invalid_url"
+	codeHostNotAllowed      = "host_not_allowed"
+	codeFetchFailed         = "fetch_failed"
+)
+
+func (e *APIError) Error() string {
+	if e.Detail != "" {
+		return e.Message + ": " + e.Detail
+	}
+	return e.Message
+}
+
+// newAPIError cria um APIError a ser enviado com o status HTTP informado
+func newAPIError(status int, code, msg, detail string) *APIError {
+	return &APIError{Status: status, Code: code, Message: msg, Detail: detail}
+}
+
+// respondAPIError envia o APIError contido em err; qualquer outro erro vira um 500
+func respondAPIError(c echo.Context, err error) error {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = newAPIError(http.StatusInternalServerError, codeStorageFailed, "Internal error", err.Error())
+	}
+	return c.JSON(apiErr.Status, apiErr)
+}
+
+// respondError envia um APIError com o status HTTP informado
+func respondError(c echo.Context, status int, code, msg string) error {
+	return c.JSON(status, APIError{Code: code, Message: msg})
+}
+
+// respondErrorDetail envia um APIError incluindo detalhes adicionais sobre a falha
+func respondErrorDetail(c echo.Context, status int, code, msg, detail string) error {
+	return c.JSON(status, APIError{Code: code, Message: msg, Detail: detail})
+}
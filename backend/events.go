@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Intervalo entre comentários de keep-alive na stream, para que proxies não derrubem a conexão
+// enquanto um arquivo demorado é convertido
+const eventsKeepAlive = 15 * time.Second
+
+// progressEvent é o dado do evento "progress" de /jobs/{id}/events
+type progressEvent struct {
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+	File      string `json:"file,omitempty"`
+}
+
+// handleJobEvents acompanha um job por Server-Sent Events. Emite "progress" a cada arquivo
+// concluído e, ao final, "done" com o estado do job (o mesmo JSON de /jobs/{id})
+func handleJobEvents(c echo.Context) error {
+	id := c.Param("id")
+	j, ok := jobs.get(id)
+	if !ok {
+		return respondError(c, http.StatusNotFound, codeJobNotFound, "Job not found")
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	lastCompleted := -1
+	for {
+		if j.Completed != lastCompleted {
+			lastCompleted = j.Completed
+			if err := writeEvent(w, "progress", progressEvent{Completed: j.Completed, Total: j.Total, File: j.lastFile}); err != nil {
+				return nil
+			}
+		}
+		if j.Status == jobDone || j.Status == jobError {
+			writeEvent(w, "done", j)
+			return nil
+		}
+
+		select {
+		case <-j.changed:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+			continue
+		case <-c.Request().Context().Done():
+			return nil
+		}
+
+		// O job pode ter expirado enquanto o cliente esperava
+		if j, ok = jobs.get(id); !ok {
+			return nil
+		}
+	}
+}
+
+// writeEvent envia um evento SSE com os dados codificados em JSON
+func writeEvent(w *echo.Response, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// fakeRunner substitui o pandoc nos testes: grava em -o (ou em stdout) um conteúdo fixo
+// e registra os argumentos e o diretório de cada execução
+type fakeRunner struct {
+	mu     sync.Mutex
+	calls  [][]string
+	dirs   []string
+	output string
+	stderr string
+	err    error
+
+	// check, se definido, é chamado durante a execução, enquanto o workspace ainda existe
+	check func(dir string, args []string)
+}
+
+func (f *fakeRunner) Run(ctx context.Context, dir string, args []string, stdout, stderr io.Writer) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, args)
+	f.dirs = append(f.dirs, dir)
+	f.mu.Unlock()
+
+	if f.check != nil {
+		f.check(dir, args)
+	}
+
+	io.WriteString(stderr, f.stderr)
+	if f.err != nil {
+		return f.err
+	}
+
+	output := argValue(args, "-o")
+	if output == "-" {
+		_, err := io.WriteString(stdout, f.output)
+		return err
+	}
+	if output != "" && output != os.DevNull {
+		return os.WriteFile(output, []byte(f.output), 0644)
+	}
+	return nil
+}
+
+// argValue retorna o valor que segue a flag nos argumentos, ou "" se ela não existir
+func argValue(args []string, flag string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// setupTest isola os diretórios de trabalho do teste em um diretório temporário
+func setupTest(t *testing.T) {
+	t.Helper()
+	previous := uploadsDir
+	uploadsDir = t.TempDir()
+	t.Cleanup(func() { uploadsDir = previous })
+}
+
+// zipArchive monta em memória um zip com os arquivos informados (nome -> conteúdo)
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadRequest monta um POST multipart com o arquivo no campo "file". Sem filename, o campo é omitido.
+func uploadRequest(t *testing.T, target, filename string, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if filename != "" {
+		w, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set(echo.HeaderContentType, mw.FormDataContentType())
+	return req
+}
+
+// serve executa o handler para a requisição e retorna a resposta gravada
+func serve(handler echo.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	if err := handler(c); err != nil {
+		e.HTTPErrorHandler(err, c)
+	}
+	return rec
+}
+
+func TestHandleConvert(t *testing.T) {
+	tests := []struct {
+		name       string
+		filename   string
+		content    []byte
+		wantStatus int
+		wantCode   string
+		wantFile   string
+		wantPandoc bool
+	}{
+		{
+			name:       "sem arquivo",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeNoFile,
+		},
+		{
+			name:       "zip inválido",
+			filename:   "docs.zip",
+			content:    []byte("isto não é um zip"),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeNotAZip,
+		},
+		{
+			name:       "zip vazio",
+			filename:   "docs.zip",
+			content:    zipArchive(t, nil),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeEmptyArchive,
+		},
+		{
+			name:       "zip sem markdown",
+			filename:   "docs.zip",
+			content:    zipArchive(t, map[string]string{"notes.txt": "texto"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   codeMarkdownNotFound,
+		},
+		{
+			name:       "extensão .markdown",
+			filename:   "docs.zip",
+			content:    zipArchive(t, map[string]string{"notes.txt": "texto", "guide.markdown": "# Guia"}),
+			wantStatus: http.StatusOK,
+			wantFile:   "guide.docx",
+			wantPandoc: true,
+		},
+		{
+			name:       "sucesso",
+			filename:   "docs.zip",
+			content:    zipArchive(t, map[string]string{"report.md": "# Relatório"}),
+			wantStatus: http.StatusOK,
+			wantFile:   "report.docx",
+			wantPandoc: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			runner := &fakeRunner{output: "docx convertido"}
+			srv := &server{runner: runner}
+
+			rec := serve(srv.handleConvert, uploadRequest(t, "/convert", tt.filename, tt.content))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, esperado %d (corpo: %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if ran := len(runner.calls) > 0; ran != tt.wantPandoc {
+				t.Errorf("pandoc executado = %v, esperado %v", ran, tt.wantPandoc)
+			}
+
+			if tt.wantCode != "" {
+				var apiErr APIError
+				if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+					t.Fatalf("resposta de erro inválida: %v", err)
+				}
+				if apiErr.Code != tt.wantCode {
+					t.Errorf("code = %q, esperado %q", apiErr.Code, tt.wantCode)
+				}
+			}
+
+			if tt.wantFile != "" {
+				wantDisposition := fmt.Sprintf("attachment; filename=%q", tt.wantFile)
+				if got := rec.Header().Get(echo.HeaderContentDisposition); got != wantDisposition {
+					t.Errorf("Content-Disposition = %q, esperado %q", got, wantDisposition)
+				}
+				if got := rec.Body.String(); got != runner.output {
+					t.Errorf("corpo = %q, esperado %q", got, runner.output)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConvertPandocFailure(t *testing.T) {
+	setupTest(t)
+	srv := &server{runner: &fakeRunner{err: &converter.ExitError{Code: 64}, stderr: "YAML parse exception"}}
+
+	rec := serve(srv.handleConvert, uploadRequest(t, "/convert", "doc.md", []byte("# Título")))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, esperado %d", rec.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rec.Body.String(), "YAML parse exception") {
+		t.Errorf("a resposta deveria incluir a saída do pandoc: %s", rec.Body)
+	}
+
+	var apiErr APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Code != codeConversionFailed || apiErr.ExitCode != 64 {
+		t.Errorf("code = %q, exit_code = %d; esperado %q e 64", apiErr.Code, apiErr.ExitCode, codeConversionFailed)
+	}
+}
+
+func TestHandleConvertPandocNotStarted(t *testing.T) {
+	setupTest(t)
+	srv := &server{runner: &fakeRunner{err: exec.ErrNotFound}}
+
+	rec := serve(srv.handleConvert, uploadRequest(t, "/convert", "doc.md", []byte("# Título")))
+
+	var apiErr APIError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatal(err)
+	}
+	if apiErr.Code != codePandocUnavailable || apiErr.ExitCode != 0 {
+		t.Errorf("code = %q, exit_code = %d; esperado %q sem exit_code", apiErr.Code, apiErr.ExitCode, codePandocUnavailable)
+	}
+}
+
+func TestHandleConvertRemovesWorkspace(t *testing.T) {
+	setupTest(t)
+	srv := &server{runner: &fakeRunner{output: "ok"}}
+
+	rec := serve(srv.handleConvert, uploadRequest(t, "/convert", "doc.md", []byte("# Título")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, esperado %d", rec.Code, http.StatusOK)
+	}
+
+	entries, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("o diretório de trabalho deveria ter sido removido, restaram %d entradas", len(entries))
+	}
+}
+
+func TestHandleConvertNestedMedia(t *testing.T) {
+	setupTest(t)
+	archive := zipArchive(t, map[string]string{
+		"docs/report.md":   "![Figura](img/pic.png)",
+		"docs/img/pic.png": "\x89PNG",
+	})
+
+	runner := &fakeRunner{output: "ok"}
+	runner.check = func(dir string, args []string) {
+		// O pandoc roda no diretório do markdown, então o link relativo da imagem é resolvido
+		if _, err := os.Stat(filepath.Join(dir, "img", "pic.png")); err != nil {
+			t.Errorf("imagem não encontrada a partir do diretório do pandoc %s: %v", dir, err)
+		}
+		// Com o diretório atual trocado, a saída precisa de um caminho absoluto
+		if output := argValue(args, "-o"); !filepath.IsAbs(output) {
+			t.Errorf("caminho de saída deveria ser absoluto: %s", output)
+		}
+	}
+	srv := &server{runner: runner}
+
+	rec := serve(srv.handleConvert, uploadRequest(t, "/convert", "docs.zip", archive))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, esperado %d (corpo: %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	if len(runner.dirs) != 1 || filepath.Base(runner.dirs[0]) != "docs" {
+		t.Errorf("pandoc deveria rodar em docs/, rodou em %v", runner.dirs)
+	}
+}
+
+func TestHandleConvertRejectsArgumentInjection(t *testing.T) {
+	const injected = "--lua-filter=evil.lua"
+	escaped := url.QueryEscape(injected)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "format", query: "format=" + escaped, wantStatus: http.StatusBadRequest},
+		{name: "from", query: "from=" + escaped, wantStatus: http.StatusBadRequest},
+		{name: "dialect", query: "dialect=" + escaped, wantStatus: http.StatusBadRequest},
+		{name: "highlight", query: "highlight=" + escaped, wantStatus: http.StatusBadRequest},
+		{name: "math", query: "format=html&math=" + escaped, wantStatus: http.StatusBadRequest},
+		{name: "nome de variável", query: "var=" + escaped, wantStatus: http.StatusBadRequest},
+		// Valores aceitos chegam ao pandoc grudados na flag, sem virar um argumento solto
+		{name: "valor de variável", query: "var=indent=" + escaped, wantStatus: http.StatusOK},
+		{name: "título", query: "title=" + escaped, wantStatus: http.StatusOK},
+		{name: "filename", query: "filename=" + escaped, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			runner := &fakeRunner{output: "ok"}
+			srv := &server{runner: runner}
+
+			rec := serve(srv.handleConvert, uploadRequest(t, "/convert?"+tt.query, "doc.md", []byte("# Título")))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, esperado %d (corpo: %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK && len(runner.calls) > 0 {
+				t.Errorf("o pandoc não deveria ter sido executado: %q", runner.calls)
+			}
+			for _, args := range runner.calls {
+				if slices.Contains(args, injected) {
+					t.Errorf("valor da requisição virou um argumento solto: %q", args)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConvertMainFile(t *testing.T) {
+	archive := zipArchive(t, map[string]string{
+		"README.md":        "# Leia-me",
+		"docs/report.md":   "# Relatório",
+		"docs/appendix.md": "# Apêndice",
+	})
+
+	tests := []struct {
+		name       string
+		main       string
+		wantStatus int
+		wantSource string
+	}{
+		{name: "arquivo escolhido", main: "docs/report.md", wantStatus: http.StatusOK, wantSource: "docs/report.md"},
+		{name: "arquivo ausente", main: "docs/missing.md", wantStatus: http.StatusNotFound},
+		{name: "fora do arquivo compactado", main: "../README.md", wantStatus: http.StatusNotFound},
+		{name: "diretório", main: "docs", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t)
+			runner := &fakeRunner{output: "docx convertido"}
+			srv := &server{runner: runner}
+
+			rec := serve(srv.handleConvert, uploadRequest(t, "/convert?main="+url.QueryEscape(tt.main), "docs.zip", archive))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, esperado %d (corpo: %s)", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantSource != "" {
+				if got := rec.Header().Get("X-Source-File"); got != tt.wantSource {
+					t.Errorf("X-Source-File = %q, esperado %q", got, tt.wantSource)
+				}
+			} else if len(runner.calls) > 0 {
+				t.Errorf("pandoc não deveria ter sido executado: %q", runner.calls)
+			}
+		})
+	}
+}
+
+func TestGzipMiddlewareSkipsCompressedFormats(t *testing.T) {
+	body := strings.Repeat("conteúdo que comprime bem ", 200)
+	tests := []struct {
+		contentType string
+		wantGzip    bool
+	}{
+		{contentType: "text/html; charset=utf-8", wantGzip: true},
+		{contentType: "text/markdown; charset=utf-8", wantGzip: true},
+		{contentType: converter.OutputFormats["docx"].ContentType, wantGzip: false},
+		{contentType: "application/pdf", wantGzip: false},
+		{contentType: "application/zip", wantGzip: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			handler := gzipMiddleware()(func(c echo.Context) error {
+				return c.Blob(http.StatusOK, tt.contentType, []byte(body))
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+
+			rec := serve(handler, req)
+
+			if gzipped := rec.Header().Get(echo.HeaderContentEncoding) == "gzip"; gzipped != tt.wantGzip {
+				t.Fatalf("comprimido = %v, esperado %v", gzipped, tt.wantGzip)
+			}
+			if !tt.wantGzip && rec.Body.String() != body {
+				t.Errorf("corpo alterado sem compressão: %d bytes", rec.Body.Len())
+			}
+		})
+	}
+}
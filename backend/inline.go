@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// inlineImage é uma imagem enviada em base64 no corpo de POST /convert/bundle
+type inlineImage struct {
+	Name          string `json:"name"` // caminho referenciado no markdown, como a.png ou img/a.png
+	ContentBase64 string `json:"content_base64"`
+}
+
+// inlineRequest é o corpo de POST /convert/bundle: o markdown e as imagens que ele referencia,
+// para clientes que não conseguem montar um zip
+type inlineRequest struct {
+	Markdown string        `json:"markdown"`
+	Format   string        `json:"format"`
+	Images   []inlineImage `json:"images"`
+
+	// Variáveis de template, somadas às de ?var=
+	Variables map[string]string `json:"variables"`
+}
+
+// handleConvertInline grava o markdown e as imagens do corpo JSON em um diretório de trabalho e
+// converte o markdown como se tivesse vindo em um zip. Valem os mesmos limites da extração de um
+// zip: quantidade de arquivos, bytes decodificados e extensões permitidas.
+// Opções de conversão (toc, standalone, ...) continuam vindo da query string
+func (s *server) handleConvertInline(c echo.Context) error {
+	logger := requestLogger(c)
+	logger.Info("Iniciando conversão de markdown com imagens em base64")
+
+	var req inlineRequest
+	if err := c.Bind(&req); err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid request body: expected JSON with markdown and images")
+	}
+	if req.Markdown == "" {
+		return respondError(c, http.StatusBadRequest, codeNoFile, "Missing markdown")
+	}
+	if int64(len(req.Markdown)) > maxSourceBytes {
+		return respondErrorDetail(c, http.StatusRequestEntityTooLarge, codeSourceTooLarge, "Source file too large",
+			fmt.Sprintf("markdown has %d bytes (maximum %d)", len(req.Markdown), maxSourceBytes))
+	}
+	// O markdown conta como uma das entradas, como dentro do zip
+	if int64(len(req.Images))+1 > extractLimits.MaxEntries {
+		return respondErrorDetail(c, http.StatusBadRequest, codeArchiveTooLarge, "Too many images",
+			fmt.Sprintf("%d images (maximum %d)", len(req.Images), extractLimits.MaxEntries-1))
+	}
+
+	if req.Format == "" {
+		req.Format = "docx"
+	}
+	format, ok := converter.OutputFormats[req.Format]
+	if !ok {
+		return respondError(c, http.StatusBadRequest, codeInvalidFormat, "Unsupported output format: "+req.Format)
+	}
+	if err := requirePDFEngine(logger, format); err != nil {
+		return respondAPIError(c, err)
+	}
+
+	opts, err := conversionOptionsFromRequest(c, format)
+	if err == nil {
+		err = setVariables(&opts, req.Variables)
+	}
+	if err != nil {
+		logger.Warn("Opções de conversão inválidas", "error", err)
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+	opts.From = converter.InputFormats[0].Reader
+
+	customName, err := filenameParam(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidFilename, err.Error())
+	}
+
+	workDir, cleanup, err := createWorkspace(c.Request().Context(), logger)
+	if err != nil {
+		logger.Error("Erro ao criar diretório de trabalho", "error", err)
+		return respondError(c, http.StatusInternalServerError, codeStorageFailed, "Failed to create working directory")
+	}
+	defer cleanup()
+
+	// As imagens ficam ao lado do markdown, para que os caminhos relativos dele as encontrem.
+	// O markdown é gravado antes, então uma imagem com o mesmo nome é recusada como repetida
+	srcDir := filepath.Join(workDir, "extracted")
+	srcFile := filepath.Join(srcDir, "input.md")
+	err = os.MkdirAll(srcDir, 0755)
+	if err == nil {
+		err = os.WriteFile(srcFile, []byte(req.Markdown), 0644)
+	}
+	if err != nil {
+		logger.Error("Erro ao gravar markdown", "error", err)
+		return respondError(c, http.StatusInternalServerError, codeStorageFailed, "Failed to save markdown")
+	}
+	if err := writeInlineImages(srcDir, req.Images); err != nil {
+		logger.Warn("Imagens inválidas", "error", err)
+		return respondAPIError(c, err)
+	}
+
+	opts, err = optionsForFormat(logger, opts, format, "")
+	if err != nil {
+		return respondErrorDetail(c, http.StatusBadRequest, codeInvalidTemplate, "Invalid template", err.Error())
+	}
+	outputPath := uniqueOutputPath(workDir, "output", format)
+	opts.MediaDir = filepath.Join(workDir, "media")
+	filename := "converted" + format.Extension
+	if customName != "" {
+		filename = withExtension(customName, format.Extension)
+	}
+	logger = logger.With("size", len(req.Markdown), "images", len(req.Images), "format", format.Writer)
+
+	// HTML com imagens externas volta em um zip com as mídias, como em /convert
+	convert := func() ([]string, error) {
+		return s.convertToDOCX(c.Request().Context(), logger, []string{srcFile}, outputPath, opts)
+	}
+	if format.Writer == "html" && !opts.Standalone {
+		convert = func() ([]string, error) {
+			return s.convertBundle(c.Request().Context(), logger, []string{srcFile}, "input.md", outputPath, opts, true)
+		}
+	}
+
+	warnings, err := convert()
+	if err != nil {
+		logger.Error("Erro na conversão", "error", err)
+		return respondConversionError(c, err)
+	}
+	logger.Info("Conversão concluída com sucesso")
+
+	filename, contentType := bundledOutput(outputPath, filename, format.ContentType)
+	setWarningsHeader(c, warnings)
+	return sendOutput(c, outputPath, filename, contentType)
+}
+
+// writeInlineImages decodifica as imagens em dir, respeitando os limites de extração de um zip.
+// Os erros são *APIError prontos para a resposta
+func writeInlineImages(dir string, images []inlineImage) error {
+	var total int64
+	for _, image := range images {
+		if image.Name == "" {
+			return newAPIError(http.StatusBadRequest, codeInvalidFilename, "Image without name", "")
+		}
+		path, err := converter.EntryPath(dir, image.Name)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidFilename, "Invalid image name", err.Error())
+		}
+		if !extractLimits.Allows(image.Name) {
+			return newAPIError(http.StatusBadRequest, codeUnsupportedFile, "Image extension is not allowed", image.Name)
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidFilename, "Duplicate image name", image.Name)
+		}
+
+		content, err := base64.StdEncoding.DecodeString(image.ContentBase64)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidParameter, "Invalid base64 content", image.Name)
+		}
+		total += int64(len(content))
+		if total > extractLimits.MaxBytes {
+			return newAPIError(http.StatusBadRequest, codeArchiveTooLarge, "Images too large",
+				fmt.Sprintf("decoded images exceed %d bytes", extractLimits.MaxBytes))
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return newAPIError(http.StatusBadRequest, codeInvalidFilename, "Invalid image name", err.Error())
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return newAPIError(http.StatusInternalServerError, codeStorageFailed, "Failed to save image", "")
+		}
+	}
+	return nil
+}
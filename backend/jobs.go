@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// Tempo padrão que um job finalizado permanece disponível para download
+const defaultJobTTL = time.Hour
+
+// jobStatus representa o estado de uma conversão assíncrona
+type jobStatus string
+
+const (
+	jobPending jobStatus = "pending"
+	jobRunning jobStatus = "running"
+	jobDone    jobStatus = "done"
+	jobError   jobStatus = "error"
+)
+
+// job é uma conversão executada em segundo plano
+type job struct {
+	ID         string     `json:"job_id"`
+	Status     jobStatus  `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	ExitCode   int        `json:"exit_code,omitempty"` // código de saída do pandoc, se ele falhou
+	Warnings   []string   `json:"warnings,omitempty"`
+	Completed  int        `json:"completed"` // arquivos já convertidos
+	Total      int        `json:"total"`     // arquivos a converter
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// Resumo da entrada e, depois de concluído, do arquivo gerado
+	Summary *conversionSummary `json:"summary,omitempty"`
+
+	outputPath  string
+	filename    string
+	contentType string
+	lastFile    string        // último arquivo concluído em um lote
+	changed     chan struct{} // fechado (e substituído) a cada atualização do job
+	cleanup     func()
+}
+
+// jobStore guarda os jobs em memória e remove os finalizados após o TTL
+type jobStore struct {
+	mu     sync.Mutex
+	jobs   map[string]*job
+	ttl    time.Duration
+	queue  *JobQueue      // fila que executa os jobs
+	active sync.WaitGroup // jobs na fila ou em execução
+}
+
+// Jobs assíncronos em andamento ou aguardando download
+var jobs = newJobStore(defaultJobTTL, NewJobQueue(runtime.NumCPU(), defaultJobQueueDepth))
+
+func newJobStore(ttl time.Duration, queue *JobQueue) *jobStore {
+	return &jobStore{jobs: make(map[string]*job), ttl: ttl, queue: queue}
+}
+
+// create registra um novo job pendente com total arquivos a converter. cleanup é chamado quando o job expira.
+func (s *jobStore) create(outputPath, filename, contentType string, total int, summary *conversionSummary, cleanup func()) *job {
+	j := &job{
+		ID:          newJobID(),
+		Status:      jobPending,
+		Total:       total,
+		CreatedAt:   time.Now(),
+		Summary:     summary,
+		outputPath:  outputPath,
+		filename:    filename,
+		contentType: contentType,
+		changed:     make(chan struct{}),
+		cleanup:     cleanup,
+	}
+
+	s.mu.Lock()
+	s.jobs[j.ID] = j
+	s.mu.Unlock()
+	return j
+}
+
+// remove descarta um job que não chegou a ser executado, sem chamar seu cleanup
+func (s *jobStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+}
+
+// get retorna uma cópia do job para que possa ser lida sem segurar o lock
+func (s *jobStore) get(id string) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// update aplica fn ao job sob o lock e avisa quem acompanha o job pela stream de eventos
+func (s *jobStore) update(id string, fn func(j *job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok {
+		fn(j)
+		close(j.changed)
+		j.changed = make(chan struct{})
+	}
+}
+
+// setProgress registra que completed arquivos do job foram convertidos, sendo file o último
+func (s *jobStore) setProgress(id string, completed int, file string) {
+	s.update(id, func(j *job) {
+		j.Completed = completed
+		j.lastFile = file
+	})
+}
+
+// removeExpired apaga os jobs finalizados há mais tempo que o TTL e seus arquivos
+func (s *jobStore) removeExpired(now time.Time) {
+	var expired []*job
+
+	s.mu.Lock()
+	for id, j := range s.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > s.ttl {
+			expired = append(expired, j)
+			delete(s.jobs, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, j := range expired {
+		slog.Info("Removendo job expirado", "job_id", j.ID)
+		j.cleanup()
+	}
+}
+
+// launch coloca fn na fila de jobs, registrando-a para que o encerramento do servidor aguarde sua
+// conclusão. Retorna errQueueFull se a fila estiver cheia
+func (s *jobStore) launch(fn func()) error {
+	s.active.Add(1)
+	err := s.queue.Submit(func() {
+		defer s.active.Done()
+		fn()
+	})
+	if err != nil {
+		s.active.Done()
+	}
+	return err
+}
+
+// wait aguarda os jobs em execução terminarem ou o contexto expirar
+func (s *jobStore) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startJanitor remove periodicamente os jobs expirados
+func (s *jobStore) startJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.removeExpired(now)
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// runJob executa a conversão de um job e registra o resultado
+func runJob(logger *slog.Logger, id string, convert func() ([]string, error)) {
+	jobs.update(id, func(j *job) { j.Status = jobRunning })
+
+	warnings, err := convert()
+
+	jobs.update(id, func(j *job) {
+		now := time.Now()
+		j.FinishedAt = &now
+		if err != nil {
+			logger.Error("Erro na conversão do job", "error", err)
+			j.Status = jobError
+			j.Error = err.Error()
+			var failure *converter.Failure
+			if errors.As(err, &failure) && failure.ExitCode > 0 {
+				j.ExitCode = failure.ExitCode
+			}
+			return
+		}
+		logger.Info("Job concluído com sucesso")
+		j.Status = jobDone
+		j.Warnings = warnings
+		j.Completed = j.Total
+		// O resumo é substituído, e não alterado, porque get devolve cópias que compartilham o ponteiro
+		if j.Summary != nil {
+			j.Summary = j.Summary.withOutput(j.outputPath)
+		}
+	})
+}
+
+// handleJobStatus retorna o estado atual de um job
+func handleJobStatus(c echo.Context) error {
+	j, ok := jobs.get(c.Param("id"))
+	if !ok {
+		return respondError(c, http.StatusNotFound, codeJobNotFound, "Job not found")
+	}
+	return c.JSON(http.StatusOK, j)
+}
+
+// handleJobResult envia o arquivo convertido de um job concluído
+func handleJobResult(c echo.Context) error {
+	j, ok := jobs.get(c.Param("id"))
+	if !ok {
+		return respondError(c, http.StatusNotFound, codeJobNotFound, "Job not found")
+	}
+	if j.Status != jobDone {
+		return respondError(c, http.StatusConflict, codeJobNotReady, "Job is not finished: "+string(j.Status))
+	}
+	filename, contentType := bundledOutput(j.outputPath, j.filename, j.contentType)
+	if j.Summary != nil {
+		setSummaryHeaders(c, j.Summary)
+	}
+	return sendOutput(c, j.outputPath, filename, contentType)
+}
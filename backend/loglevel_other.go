@@ -0,0 +1,6 @@
+//go:build !unix
+
+package main
+
+// watchLogLevelSignal não faz nada nesta plataforma, que não tem SIGUSR1
+func watchLogLevelSignal() {}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevelSignal alterna entre o nível debug e o nível configurado a cada SIGUSR1,
+// para investigar um problema em produção sem reiniciar o servidor
+func watchLogLevelSignal() {
+	configured := logLevel.Level()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	for range signals {
+		level := slog.LevelDebug
+		if logLevel.Level() == slog.LevelDebug {
+			level = configured
+		}
+		logLevel.Set(level)
+		slog.Warn("Nível de log alterado", "level", level.String())
+	}
+}
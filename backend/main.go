@@ -1,218 +1,1450 @@
 package main
 
 import (
-	"archive/zip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
-	"mime/multipart"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// server reúne as dependências dos handlers que executam o pandoc
+type server struct {
+	runner converter.Runner
+}
+
+// archiveFormat descreve o zip devolvido quando a resposta reúne vários arquivos convertidos
+var archiveFormat = converter.OutputFormat{Extension: ".zip", ContentType: "application/zip"}
+
+// Diretório onde ficam os diretórios de trabalho de cada requisição, configurável via UPLOADS_DIR.
+// Fica sob o diretório temporário do sistema por padrão e é resolvido para um caminho absoluto na inicialização
+var uploadsDir = filepath.Join(os.TempDir(), "markdown-converter")
+
+// Executável do pandoc, configurável via PANDOC_BIN
+var pandocBin = "pandoc"
+
+// Filtros do pandoc aplicados a todas as conversões, configuráveis via PANDOC_FILTERS
+// (ex.: mermaid-filter,/etc/pandoc/diagram.lua). Arquivos .lua são passados com --lua-filter
+var pandocFilters []string
+
+// Arquivo de defaults do pandoc (--defaults) aplicado a todas as conversões, configurável via
+// PANDOC_DEFAULTS. As opções de cada requisição sobrescrevem as do arquivo
+var pandocDefaults string
+
+// Engine usado pelo pandoc para gerar PDF, configurável via PDF_ENGINE. Se ele falhar, as
+// conversões tentam os engines de pdfEngineFallbacks que estiverem instalados, na ordem
+var (
+	pdfEngine          = "pdflatex"
+	pdfEngineFallbacks []string
+	pdfEngineAvailable bool
+)
+
+// Ordem padrão dos engines alternativos de PDF, configurável via PDF_ENGINE_FALLBACKS
+var defaultPDFEngineFallbacks = []string{"xelatex", "pdflatex", "wkhtmltopdf", "weasyprint"}
+
+// Tamanho máximo padrão de upload: 50MB
+const defaultMaxUploadBytes = 50 << 20
+
+// Limite de upload em bytes, configurável via MAX_UPLOAD_BYTES
+var maxUploadBytes int64 = defaultMaxUploadBytes
+
+// Tamanho máximo padrão de cada arquivo de origem: 20MB. Um zip pequeno pode conter um markdown
+// enorme que o pandoc levaria muito tempo e memória para processar
+const defaultMaxSourceBytes = 20 << 20
+
+// Limite de cada arquivo de origem em bytes, configurável via MAX_SOURCE_BYTES
+var maxSourceBytes int64 = defaultMaxSourceBytes
+
+// Limites de extração dos arquivos compactados, configuráveis via MAX_EXTRACTED_BYTES,
+// MAX_ARCHIVE_ENTRIES e EXTRACT_ALLOWED_EXTENSIONS
+var extractLimits = converter.DefaultLimits
+
+// Tempo padrão de espera por uma vaga de conversão
+const defaultConversionWait = 30 * time.Second
+
+// Semáforo que limita quantos processos do pandoc rodam ao mesmo tempo
+var (
+	conversionSlots = make(chan struct{}, runtime.NumCPU())
+	conversionWait  = defaultConversionWait
+)
+
+// Contexto compartilhado pelos processos do pandoc, cancelado no encerramento do servidor
+var conversionCtx, cancelConversions = context.WithCancel(context.Background())
+
+// Tempo padrão para aguardar conversões em andamento no encerramento
+const defaultShutdownTimeout = 30 * time.Second
+
+// Versão da aplicação, definida na compilação com -ldflags "-X main.buildVersion=1.2.3"
+var buildVersion = "dev"
+
+// Tempo máximo padrão de execução do pandoc, configurável via PANDOC_TIMEOUT
+const defaultPandocTimeout = 60 * time.Second
+
+var pandocTimeout = defaultPandocTimeout
+
+// Versão do pandoc detectada por checkPandoc (ex.: 3.1.11), enviada no cabeçalho X-Pandoc-Version.
+// Fica vazia enquanto o pandoc não for encontrado: o servidor sobe mesmo assim, em modo degradado,
+// e as conversões respondem 503 até que waitForPandoc o encontre
+var detectedPandocVersion atomic.Value
+
+// Intervalo padrão entre as verificações do pandoc em modo degradado
+const defaultPandocRetryInterval = 10 * time.Second
+
+// Intervalo entre as verificações do pandoc em modo degradado, configurável via PANDOC_RETRY_INTERVAL
+var pandocRetryInterval = defaultPandocRetryInterval
+
+// pandocReady retorna a versão do pandoc e se ele já foi encontrado
+func pandocReady() (string, bool) {
+	version, _ := detectedPandocVersion.Load().(string)
+	return version, version != ""
+}
+
+// Nível mínimo dos logs, configurável via LOG_LEVEL (debug, info, warn, error). Em debug
+// aparecem também os detalhes de cada conversão, como cada entrada extraída dos arquivos compactados.
+// Em sistemas unix, SIGUSR1 liga e desliga o nível debug sem reiniciar o servidor
+var logLevel = new(slog.LevelVar)
+
+// setLogLevel ajusta o nível dos logs; valores inválidos mantêm o nível atual
+func setLogLevel(value string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		slog.Warn("Valor inválido em LOG_LEVEL, mantendo o nível atual", "value", value, "level", logLevel.Level().String())
+		return
+	}
+	logLevel.Set(level)
+}
+
+// errServerBusy indica que não foi possível obter uma vaga de conversão a tempo
+var errServerBusy = errors.New("servidor ocupado: limite de conversões simultâneas atingido")
+
 func main() {
+	// Com -in e -out o binário faz uma única conversão pela linha de comando em vez de subir o servidor
+	cliOpts, cliMode, err := parseCLIFlags(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "erro:", err)
+		os.Exit(2)
+	}
+
+	// Logs estruturados em JSON; cada requisição carrega o campo request_id.
+	// Na linha de comando os logs vão para stderr, deixando stdout livre para scripts
+	logOutput := os.Stdout
+	if cliMode {
+		logOutput = os.Stderr
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logOutput, &slog.HandlerOptions{Level: logLevel})))
+	setLogLevel(getEnv("LOG_LEVEL", "info"))
+	go watchLogLevelSignal()
+
+	// Sem o pandoc o servidor sobe em modo degradado, para responder ao health check e explicar o
+	// problema aos clientes; o pandoc pode ser instalado depois. Na linha de comando não há o que fazer sem ele
+	pandocBin = getEnv("PANDOC_BIN", "pandoc")
 	if err := checkPandoc(); err != nil {
-		log.Fatalf("Erro crítico: %v", err)
+		if cliMode {
+			slog.Error("Erro crítico", "error", err)
+			os.Exit(1)
+		}
+		slog.Error("Pandoc indisponível, servidor subindo em modo degradado", "error", err)
+		pandocRetryInterval = getEnvDuration("PANDOC_RETRY_INTERVAL", defaultPandocRetryInterval)
+		go waitForPandoc(pandocRetryInterval)
+	}
+	pdfEngine, pdfEngineFallbacks, pdfEngineAvailable = checkPDFEngines(getEnv("PDF_ENGINE", "pdflatex"), getEnvList("PDF_ENGINE_FALLBACKS", defaultPDFEngineFallbacks))
+	pandocFilters = checkPandocFilters(getEnvList("PANDOC_FILTERS", nil))
+	if defaults := os.Getenv("PANDOC_DEFAULTS"); defaults != "" {
+		path, err := checkPandocDefaults(defaults)
+		if err != nil {
+			slog.Error("Erro crítico: arquivo de defaults do pandoc inválido", "path", defaults, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Arquivo de defaults do pandoc", "path", path)
+		pandocDefaults = path
+	}
+
+	uploadField = getEnv("UPLOAD_FIELD", "file")
+	if templatesDir = os.Getenv("TEMPLATES_DIR"); templatesDir != "" {
+		if info, err := os.Stat(templatesDir); err != nil || !info.IsDir() {
+			slog.Warn("TEMPLATES_DIR não é um diretório acessível, ?reference= vai falhar", "dir", templatesDir, "error", err)
+		} else {
+			slog.Info("Documentos de referência compartilhados", "dir", templatesDir)
+		}
+	}
+	multipartMemory = getEnvInt64("MULTIPART_MEMORY_BYTES", defaultMultipartMemory)
+	slog.Info("Memória máxima por formulário multipart; o excedente vai para disco", "bytes", multipartMemory)
+	maxUploadBytes = getEnvInt64("MAX_UPLOAD_BYTES", defaultMaxUploadBytes)
+	slog.Info("Tamanho máximo de upload", "bytes", maxUploadBytes)
+	maxSourceBytes = getEnvInt64("MAX_SOURCE_BYTES", defaultMaxSourceBytes)
+	slog.Info("Tamanho máximo do arquivo de origem", "bytes", maxSourceBytes)
+	extractLimits.MaxBytes = getEnvInt64("MAX_EXTRACTED_BYTES", converter.DefaultLimits.MaxBytes)
+	extractLimits.MaxEntries = getEnvInt64("MAX_ARCHIVE_ENTRIES", converter.DefaultLimits.MaxEntries)
+	extractLimits.AllowedExtensions = converter.NormalizeExtensions(getEnvList("EXTRACT_ALLOWED_EXTENSIONS", nil))
+	if len(extractLimits.AllowedExtensions) > 0 {
+		slog.Info("Extensões permitidas na extração", "extensions", extractLimits.AllowedExtensions)
 	}
+
+	remoteAllowedHosts = normalizeHosts(getEnvList("REMOTE_ALLOWED_HOSTS", nil))
+	remoteClient = newRemoteClient(getEnvDuration("REMOTE_FETCH_TIMEOUT", defaultRemoteFetchTimeout))
+	if len(remoteAllowedHosts) > 0 {
+		slog.Info("Hosts permitidos em /convert/url", "hosts", remoteAllowedHosts)
+	}
+
+	minFreeDiskBytes = uint64(getEnvInt64("MIN_FREE_DISK_BYTES", defaultMinFreeDiskBytes))
+	diskSpaceMultiplier = uint64(getEnvInt64("DISK_SPACE_MULTIPLIER", defaultDiskSpaceMultiplier))
+
+	conversionSlots = make(chan struct{}, getEnvInt64("MAX_CONCURRENT_CONVERSIONS", int64(runtime.NumCPU())))
+	conversionWait = getEnvDuration("CONVERSION_WAIT_TIMEOUT", defaultConversionWait)
+	pandocTimeout = getEnvDuration("PANDOC_TIMEOUT", defaultPandocTimeout)
+	requestTimeout = getEnvDuration("REQUEST_TIMEOUT", defaultRequestTimeout)
+	slog.Info("Conversões simultâneas permitidas", "max", cap(conversionSlots))
+
+	if cliMode {
+		os.Exit(runCLI(cliOpts))
+	}
+
+	// Criar o diretório de uploads uma única vez, em vez de a cada requisição
+	dir, err := filepath.Abs(getEnv("UPLOADS_DIR", uploadsDir))
+	if err == nil {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		slog.Error("Erro crítico: não foi possível criar o diretório de uploads", "dir", dir, "error", err)
+		os.Exit(1)
+	}
+	uploadsDir = dir
+	slog.Info("Diretório de uploads", "dir", uploadsDir)
+
+	keepTemp = getEnvBool("KEEP_TEMP", false)
+	if keepTemp {
+		slog.Warn("KEEP_TEMP ativo: diretórios de trabalho mantidos para depuração", "dir", uploadsDir)
+	}
+
+	// Remover sobras de execuções anteriores que terminaram no meio de uma conversão
+	staleAge := getEnvDuration("STALE_UPLOAD_AGE", defaultStaleUploadAge)
+	if removed, err := removeStaleUploads(uploadsDir, staleAge); err != nil {
+		slog.Error("Erro ao limpar uploads órfãos", "error", err)
+	} else {
+		slog.Info("Uploads órfãos removidos", "count", removed, "older_than", staleAge.String())
+	}
+
+	// Cache das saídas de conversões idênticas, recriado a cada inicialização
+	cacheMaxBytes := getEnvInt64("CACHE_MAX_BYTES", defaultCacheMaxBytes)
+	if cache, err := newOutputCache(filepath.Join(uploadsDir, "cache"), cacheMaxBytes); err != nil {
+		slog.Error("Erro ao criar cache de conversões, seguindo sem cache", "error", err)
+	} else {
+		conversionCache = cache
+		slog.Info("Cache de conversões", "max_bytes", cacheMaxBytes)
+	}
+
+	// Varrer periodicamente as sobras que escaparem da limpeza de cada requisição
+	go sweepStaleUploads(getEnvDuration("STALE_UPLOAD_SWEEP_INTERVAL", defaultStaleUploadSweepInterval), staleAge)
+
+	jobQueue := NewJobQueue(int(getEnvInt64("JOB_WORKERS", int64(cap(conversionSlots)))), int(getEnvInt64("JOB_QUEUE_DEPTH", defaultJobQueueDepth)))
+	slog.Info("Fila de jobs assíncronos", "workers", jobQueue.workers, "depth", jobQueue.Cap())
+	jobs = newJobStore(getEnvDuration("JOB_TTL", defaultJobTTL), jobQueue)
+	go jobs.startJanitor(time.Minute)
+
+	if err := setupTracing(context.Background()); err != nil {
+		slog.Error("Erro ao configurar o tracing, seguindo sem exportar traces", "error", err)
+	}
+
 	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+
+	// Gerar um X-Request-ID para correlacionar os logs de cada requisição
+	e.Use(middleware.RequestID())
+	e.Use(tracingMiddleware())
 
-	// Configurar CORS
+	// Comprimir as respostas de texto (HTML, markdown, JSON) para clientes que aceitam gzip
+	e.Use(gzipMiddleware())
+
+	// Configurar CORS. Sem CORS_ORIGINS qualquer origem é aceita, o que só é adequado para desenvolvimento
+	corsOrigins := getEnvList("CORS_ORIGINS", []string{"*"})
+	slog.Info("Origens CORS permitidas", "origins", corsOrigins)
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{http.MethodGet, http.MethodPost},
+		AllowOrigins: corsOrigins,
+		AllowMethods: getEnvList("CORS_METHODS", []string{http.MethodGet, http.MethodPost}),
+		AllowHeaders: getEnvList("CORS_HEADERS", nil),
+		// Sem ExposeHeaders o navegador esconde do JavaScript os cabeçalhos de diagnóstico da resposta
+		ExposeHeaders: []string{
+			echo.HeaderContentDisposition, echo.HeaderXRequestID, "X-Source-File", "X-Source-Bytes",
+			"X-Output-Bytes", "X-Archive-Entries", "X-Pandoc-Version", "X-Pandoc-Warnings",
+			"X-Missing-Images",
+		},
 	}))
 
-	e.POST("/convert", handleConvert)
+	// Com API_KEY definida, as rotas de conversão (e os jobs gerados por elas) exigem a chave.
+	// Sem ela, ficam abertas para desenvolvimento local
+	var auth []echo.MiddlewareFunc
+	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+		auth = append(auth, apiKeyAuth(apiKey))
+	} else {
+		slog.Warn("API_KEY não definida: rotas de conversão sem autenticação")
+	}
+
+	// Limitar as conversões por IP antes mesmo de conferir a chave de API
+	perMinute := getEnvInt64("RATE_LIMIT_PER_MINUTE", defaultRateLimitPerMinute)
+	slog.Info("Limite de conversões por IP", "per_minute", perMinute)
+
+	// Rejeitar corpos maiores que o limite antes de gravar qualquer coisa em disco
+	bodyLimit := middleware.BodyLimit(strconv.FormatInt(maxUploadBytes, 10) + "B")
+	convertMiddleware := append([]echo.MiddlewareFunc{rateLimit(perMinute)}, auth...)
+	if requestTimeout > 0 {
+		slog.Info("Tempo máximo das requisições de conversão", "timeout", requestTimeout.String())
+		convertMiddleware = append([]echo.MiddlewareFunc{requestTimeoutMiddleware(requestTimeout)}, convertMiddleware...)
+	}
+	convertMiddleware = append(convertMiddleware, requirePandoc, bodyLimit, parseMultipartForm)
+	srv := &server{runner: converter.ExecRunner{Bin: pandocBin}}
+	e.POST("/convert", srv.handleConvert, convertMiddleware...)
+	e.POST("/convert/raw", srv.handleConvertRaw, convertMiddleware...)
+	e.POST("/convert/text", srv.handleConvertText, convertMiddleware...)
+	e.POST("/convert/url", srv.handleConvertURL, convertMiddleware...)
+	e.POST("/convert/bundle", srv.handleConvertInline, convertMiddleware...)
+	e.POST("/validate", srv.handleValidate, convertMiddleware...)
+	e.GET("/jobs/:id", handleJobStatus, auth...)
+	e.GET("/jobs/:id/result", handleJobResult, auth...)
+	e.GET("/jobs/:id/events", handleJobEvents, auth...)
+	e.GET("/formats", handleFormats)
+	e.GET("/health", handleHealth)
+	e.GET("/version", handleVersion)
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+
+	// Iniciar o servidor em segundo plano e aguardar SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	e.Logger.Fatal(e.Start(":8080"))
+	addr := listenAddr()
+	slog.Info("Servidor escutando", "addr", addr, "version", buildVersion)
+
+	go func() {
+		if err := e.Start(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Erro ao iniciar o servidor", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	shutdown(e, getEnvDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+}
+
+// shutdown encerra o servidor aguardando as conversões em andamento até o timeout.
+// Conversões que não terminarem a tempo são canceladas e os diretórios de trabalho restantes removidos.
+func shutdown(e *echo.Echo, timeout time.Duration) {
+	slog.Info("Encerrando servidor, aguardando conversões em andamento", "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Parar de aceitar requisições e aguardar as que estão em andamento
+	if err := e.Shutdown(ctx); err != nil {
+		slog.Error("Erro ao encerrar o servidor HTTP", "error", err)
+	}
+
+	// Aguardar os jobs assíncronos
+	if err := jobs.wait(ctx); err != nil {
+		slog.Warn("Jobs assíncronos não terminaram a tempo", "error", err)
+	}
+
+	// Matar os processos do pandoc que ainda estiverem rodando
+	cancelConversions()
+
+	removeActiveWorkspaces()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("Erro ao enviar os traces pendentes", "error", err)
+	}
+	slog.Info("Servidor encerrado")
 }
 
-func handleConvert(c echo.Context) error {
-	log.Println("Iniciando processo de conversão")
+func (s *server) handleConvert(c echo.Context) error {
+	logger := requestLogger(c)
+	logger.Info("Iniciando processo de conversão")
 
-	// Obter o arquivo do formulário
-	file, err := c.FormFile("file")
+	// Com ?formats=docx,pdf,html o documento é convertido para cada formato e devolvido em um zip
+	targets, err := outputFormatsParam(c)
 	if err != nil {
-		log.Printf("Erro ao obter arquivo: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "No file uploaded"})
+		logger.Warn("Formatos de saída inválidos", "formats", c.QueryParam("formats"), "error", err)
+		return respondError(c, http.StatusBadRequest, codeInvalidFormat, err.Error())
+	}
+	if err := requirePDFEngine(logger, targets...); err != nil {
+		return respondAPIError(c, err)
 	}
-	log.Printf("Arquivo recebido: %s", file.Filename)
 
-	// Criar diretório de uploads se não existir
-	uploadsDir := "uploads"
-	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
-		log.Printf("Erro ao criar diretório de uploads: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create uploads directory"})
+	// Validar o formato de saída solicitado
+	format, ok := outputFormatParam(c, defaultOutputFormat(c))
+	if !ok {
+		logger.Warn("Formato de saída não suportado", "format", c.QueryParam("format"))
+		return respondError(c, http.StatusBadRequest, codeInvalidFormat, "Unsupported output format: "+c.QueryParam("format"))
+	}
+	if err := requirePDFEngine(logger, format); err != nil {
+		return respondAPIError(c, err)
 	}
 
-	// Salvar o arquivo zip
-	zipPath := filepath.Join(uploadsDir, file.Filename)
-	if err := saveUploadedFile(file, zipPath); err != nil {
-		log.Printf("Erro ao salvar arquivo: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save file"})
+	// Opções adicionais do pandoc (sumário, metadados, ...)
+	opts, err := conversionOptionsFromRequest(c, format)
+	if err != nil {
+		logger.Warn("Opções de conversão inválidas", "error", err)
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
 	}
 
-	// Extrair o zip
-	extractPath := filepath.Join(uploadsDir, "extracted_"+filepath.Base(zipPath))
-	if err := unzipFile(zipPath, extractPath); err != nil {
-		log.Printf("Erro ao extrair zip: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to extract zip: " + err.Error()})
+	// Formato de entrada (?from=). Sem ele, o reader é detectado pela extensão do arquivo de origem
+	from, err := inputFormatParam(c)
+	if err != nil {
+		logger.Warn("Formato de entrada não suportado", "from", c.QueryParam("from"))
+		return respondError(c, http.StatusBadRequest, codeInvalidInputFormat, err.Error())
 	}
 
-	// Encontrar o arquivo markdown
-	mdFile, err := findMarkdownFile(extractPath)
+	// Modo de conversão dos arquivos markdown do zip (?mode=single|merge|batch).
+	// ?merge=true continua aceito como sinônimo de ?mode=merge
+	mode, err := conversionModeParam(c)
 	if err != nil {
-		log.Printf("Erro ao encontrar arquivo markdown: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+	if len(targets) > 0 && mode == modeBatch {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "formats cannot be combined with mode=batch")
 	}
 
-	// Converter para DOCX
-	docxPath := filepath.Join(extractPath, "output.docx")
-	if err := convertToDOCX(mdFile, docxPath); err != nil {
-		log.Printf("Erro na conversão: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Conversion failed: " + err.Error()})
+	// Com ?continue_on_error=true os arquivos do lote que falharem são pulados e listados em um report.json
+	continueOnError, err := queryBool(c, "continue_on_error")
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid value for continue_on_error: "+c.QueryParam("continue_on_error"))
+	}
+	if continueOnError && mode != modeBatch {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "continue_on_error is only supported with mode=batch")
 	}
 
-	// Configurar a limpeza para ser executada após o envio do arquivo
+	// Com ?bundle=true o HTML volta em um zip junto com as imagens extraídas pelo pandoc
+	bundle, err := queryBool(c, "bundle")
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid value for bundle: "+c.QueryParam("bundle"))
+	}
+	if bundle && (format.Writer != "html" || len(targets) > 0 || mode == modeBatch) {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "bundle is only supported for a single html output")
+	}
+
+	// Com ?async=true a conversão roda em segundo plano e o cliente consulta /jobs/{id}
+	async, err := queryBool(c, "async")
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid value for async: "+c.QueryParam("async"))
+	}
+
+	// Com ?stream=true a saída do pandoc é enviada diretamente na resposta, sem passar pelo disco
+	stream, err := queryBool(c, "stream")
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid value for stream: "+c.QueryParam("stream"))
+	}
+
+	// Com ?filename= o cliente escolhe o nome do arquivo devolvido; a extensão vem do formato
+	customName, err := filenameParam(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidFilename, err.Error())
+	}
+
+	// Com ?response=json o arquivo convertido volta em base64 dentro de um JSON, em vez de um anexo binário
+	jsonResponse, err := responseModeParam(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+
+	// Recusar o upload logo de início se não houver espaço para o arquivo, sua extração e a saída
+	if err := checkDiskSpace(logger, c.Request().ContentLength); err != nil {
+		return respondAPIError(c, err)
+	}
+
+	// Receber o arquivo. A limpeza do diretório de trabalho roda ao final da requisição ou quando o
+	// cliente se desconecta, a menos que a conversão seja entregue a um job assíncrono, que passa a ser o responsável
+	uploadCtx := c.Request().Context()
+	if async {
+		uploadCtx = context.WithoutCancel(uploadCtx)
+	}
+	upload, err := receiveUpload(uploadCtx, c, logger, from, mode != modeSingle)
+	if err != nil {
+		return respondAPIError(c, err)
+	}
+	ownsWorkspace := true
 	defer func() {
-		if err := os.RemoveAll(extractPath); err != nil {
-			log.Printf("Erro ao remover diretório temporário: %v", err)
-		}
-		if err := os.Remove(zipPath); err != nil {
-			log.Printf("Erro ao remover arquivo zip: %v", err)
+		if ownsWorkspace {
+			upload.Cleanup()
 		}
 	}()
+	logger = logger.With("upload", upload.Name)
+
+	workDir, extractPath, mdFiles, cleanup := upload.WorkDir, upload.ExtractPath, upload.Files, upload.Cleanup
+	opts.From = upload.From.Reader
+
+	// Documento de referência com os estilos do DOCX ou do PPTX, enviado no formulário ou dentro do zip
+	opts.ReferenceDoc, err = findReferenceDoc(c, workDir, extractPath, format.Writer)
+	if err != nil {
+		logger.Warn("Documento de referência inválido", "error", err)
+		return respondErrorDetail(c, http.StatusBadRequest, codeInvalidReference, "Invalid reference document", err.Error())
+	}
+
+	// Bibliografia para resolver citações [@chave], quando o zip inclui um arquivo .bib
+	if extractPath != "" {
+		opts.Bibliography, opts.CSL, err = findCitationFiles(extractPath)
+		if err != nil {
+			logger.Error("Erro ao procurar bibliografia", "error", err)
+			return respondErrorDetail(c, http.StatusInternalServerError, codeExtractFailed, "Failed to read extracted files", err.Error())
+		}
+		if opts.Bibliography != "" {
+			logger.Info("Processando citações", "bibliography", opts.Bibliography, "csl", opts.CSL)
+		}
+
+		// Capa e metadados do EPUB; descartados (com log) se o formato de saída não for EPUB
+		opts.EpubCover, opts.EpubMetadata, err = findEpubFiles(extractPath)
+		if err != nil {
+			logger.Error("Erro ao procurar arquivos do EPUB", "error", err)
+			return respondErrorDetail(c, http.StatusInternalServerError, codeExtractFailed, "Failed to read extracted files", err.Error())
+		}
+	}
+
+	outputPath := uniqueOutputPath(workDir, "output", format)
+	opts.MediaDir = filepath.Join(workDir, "media")
+
+	// Opções que dependem do formato de saída, como o template do zip
+	targetOpts := make([]converter.Options, len(targets))
+	for i, target := range targets {
+		targetOpts[i], err = optionsForFormat(logger, opts, target, extractPath)
+		if err != nil {
+			logger.Warn("Template inválido", "error", err)
+			return respondErrorDetail(c, http.StatusBadRequest, codeInvalidTemplate, "Invalid template", err.Error())
+		}
+	}
+	if len(targets) == 0 {
+		opts, err = optionsForFormat(logger, opts, format, extractPath)
+		if err != nil {
+			logger.Warn("Template inválido", "error", err)
+			return respondErrorDetail(c, http.StatusBadRequest, codeInvalidTemplate, "Invalid template", err.Error())
+		}
+	}
+
+	// Nomear a saída a partir do arquivo de origem; ao mesclar vários arquivos, usar o nome do zip
+	source := mdFiles[0]
+	if !upload.IsArchive || len(mdFiles) > 1 {
+		source = upload.Name
+	}
+	filename := outputFilename(source, format)
+	contentType := format.ContentType
+	formatLabel := format.Writer
+	if len(targets) > 0 {
+		formatLabel = c.QueryParam("formats")
+	}
+	logger = logger.With("source", sourcePaths(workDir, mdFiles), "from", opts.From, "format", formatLabel, "mode", mode)
+
+	// Resumo da entrada, devolvido nos cabeçalhos ou no job
+	summary := newConversionSummary(upload)
+	if len(summary.MissingImages) > 0 {
+		logger.Warn("Imagens referenciadas não encontradas no upload", "missing_images", summary.MissingImages)
+	}
+
+	convert := func() ([]string, error) { return s.convertToDOCX(uploadCtx, logger, mdFiles, outputPath, opts) }
+
+	// Progresso do lote, reportado ao job quando a conversão é assíncrona
+	var progress func(completed int, file string)
+
+	// Em modo batch cada markdown vira um arquivo separado, devolvidos juntos em um zip
+	if mode == modeBatch {
+		baseDir := workDir
+		if extractPath != "" {
+			baseDir = extractPath
+		}
+		outputPath = uniqueOutputPath(workDir, "output", archiveFormat)
+		filename = outputFilename(upload.Name, archiveFormat)
+		contentType = archiveFormat.ContentType
+		convert = func() ([]string, error) {
+			return s.convertBatch(uploadCtx, logger, mdFiles, baseDir, outputPath, opts, continueOnError, progress)
+		}
+	}
 
-	log.Println("Conversão concluída com sucesso")
+	// Com vários formatos, cada saída recebe o nome do arquivo de origem e todas vão em um zip
+	if len(targets) > 0 {
+		outputPath = uniqueOutputPath(workDir, "output", archiveFormat)
+		filename = outputFilename(source, archiveFormat)
+		contentType = archiveFormat.ContentType
+		convert = func() ([]string, error) {
+			return s.convertFormats(uploadCtx, logger, mdFiles, source, outputPath, targetOpts)
+		}
+	}
+
+	// Com bundle, o HTML e a pasta de mídias vão juntos em um zip
+	if bundle {
+		outputPath = uniqueOutputPath(workDir, "output", archiveFormat)
+		filename = outputFilename(source, archiveFormat)
+		contentType = archiveFormat.ContentType
+		convert = func() ([]string, error) {
+			return s.convertBundle(uploadCtx, logger, mdFiles, source, outputPath, opts, false)
+		}
+	}
+
+	// HTML com imagens externas volta automaticamente em um zip com a pasta de mídias; sem mídias,
+	// volta só o HTML. O mesmo vale para o markdown gerado a partir de um .docx com imagens.
+	// ?bundle=false desliga o zip automático e ?bundle=true o força mesmo sem mídias
+	autoBundle := !bundle && c.QueryParam("bundle") != "false" && mode != modeBatch && len(targets) == 0 &&
+		(format.Writer == "html" && !opts.Standalone || format.Text && upload.From.Binary && !opts.NoExtractMedia)
+	if autoBundle {
+		convert = func() ([]string, error) {
+			return s.convertBundle(uploadCtx, logger, mdFiles, source, outputPath, opts, true)
+		}
+	}
+
+	if customName != "" {
+		filename = withExtension(customName, filepath.Ext(filename))
+	}
+
+	// Conversões idênticas (mesmo arquivo enviado e mesmos argumentos do pandoc) são servidas do cache
+	cached := false
+	if conversionCache != nil {
+		args := [][]string{{string(mode), formatLabel, strconv.FormatBool(bundle), strconv.FormatBool(autoBundle), strconv.FormatBool(continueOnError)}, s.pandoc().Args(mdFiles, outputPath, opts)}
+		for _, targetOpt := range targetOpts {
+			args = append(args, s.pandoc().Args(mdFiles, outputPath, targetOpt))
+		}
+		key, err := conversionCacheKey(upload, opts.ReferenceDoc, args...)
+		if err != nil {
+			logger.Warn("Erro ao calcular chave de cache", "error", err)
+		} else {
+			cached = conversionCache.contains(key)
+			convert = conversionCache.wrap(logger, key, outputPath, convert)
+		}
+	}
+
+	// Em modo assíncrono, responder imediatamente com o ID do job
+	if async {
+		// Um lote avança a cada arquivo; as demais conversões contam como um único passo
+		total := 1
+		if mode == modeBatch {
+			total = len(mdFiles)
+		}
+		j := jobs.create(outputPath, filename, contentType, total, summary, cleanup)
+		progress = func(completed int, file string) { jobs.setProgress(j.ID, completed, file) }
+		ownsWorkspace = false
+		logger = logger.With("job_id", j.ID)
+		if err := jobs.launch(func() { runJob(logger, j.ID, convert) }); err != nil {
+			logger.Warn("Fila de jobs cheia, recusando conversão", "depth", jobs.queue.Cap())
+			jobs.remove(j.ID)
+			ownsWorkspace = true
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(conversionWait.Seconds())))
+			return respondError(c, http.StatusServiceUnavailable, codeQueueFull, "Conversion queue is full, try again later")
+		}
+
+		logger.Info("Conversão enfileirada")
+		return c.JSON(http.StatusAccepted, map[string]string{"job_id": j.ID})
+	}
+
+	// Converter para o formato solicitado. Formatos que o pandoc não escreve em
+	// stdout (como PDF) continuam usando o arquivo em disco mesmo com ?stream=true.
+	// No streaming os avisos do pandoc só aparecem nos logs, pois os cabeçalhos já foram enviados
+	if stream && !cached && !jsonResponse && !bundle && format.Streamable && mode != modeBatch && len(targets) == 0 {
+		convert = func() ([]string, error) { return nil, s.streamConversion(c, logger, mdFiles, opts, filename) }
+	}
+	setSummaryHeaders(c, summary)
+
+	warnings, err := convert()
+	if err != nil {
+		logger.Error("Erro na conversão", "error", err)
+		return respondConversionError(c, err)
+	}
+
+	if c.Response().Committed {
+		logger.Info("Conversão concluída com sucesso")
+		return nil
+	}
+
+	filename, contentType = bundledOutput(outputPath, filename, contentType)
+	summary = summary.withOutput(outputPath)
+	logger.Info("Conversão concluída com sucesso", "source_bytes", summary.SourceBytes, "output_bytes", summary.OutputBytes)
 
 	// Enviar o arquivo convertido
-	return c.Attachment(docxPath, "converted.docx")
+	setWarningsHeader(c, warnings)
+	setSummaryHeaders(c, summary)
+	if jsonResponse {
+		return sendOutputJSON(c, outputPath, filename, contentType)
+	}
+	return sendOutput(c, outputPath, filename, contentType)
 }
 
-func saveUploadedFile(file *multipart.FileHeader, dst string) error {
-	src, err := file.Open()
+// handleConvertRaw converte markdown enviado diretamente no corpo da requisição (text/markdown)
+func (s *server) handleConvertRaw(c echo.Context) error {
+	return s.convertRaw(c, "docx", false)
+}
+
+// handleConvertText normaliza o markdown enviado no corpo da requisição: o pandoc lê e reescreve
+// o texto (tabelas, títulos, listas), devolvido como text/markdown. Com ?format=gfm a saída é GitHub
+// Flavored Markdown; apenas formatos de texto são aceitos
+func (s *server) handleConvertText(c echo.Context) error {
+	return s.convertRaw(c, "markdown", true)
+}
+
+// convertRaw converte o corpo da requisição para ?format= (fallback por padrão). Com textOnly,
+// formatos binários como docx e pdf são recusados
+func (s *server) convertRaw(c echo.Context, fallback string, textOnly bool) error {
+	logger := requestLogger(c)
+	logger.Info("Iniciando conversão de markdown enviado no corpo da requisição")
+
+	format, ok := outputFormatParam(c, fallback)
+	if !ok || (textOnly && !format.Text) {
+		logger.Warn("Formato de saída não suportado", "format", c.QueryParam("format"))
+		return respondError(c, http.StatusBadRequest, codeInvalidFormat, "Unsupported output format: "+c.QueryParam("format"))
+	}
+	if err := requirePDFEngine(logger, format); err != nil {
+		return respondAPIError(c, err)
+	}
+
+	// Opções adicionais do pandoc (sumário, metadados, ...)
+	opts, err := conversionOptionsFromRequest(c, format)
 	if err != nil {
-		return err
+		logger.Warn("Opções de conversão inválidas", "error", err)
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
 	}
-	defer src.Close()
 
-	out, err := os.Create(dst)
+	stream, err := queryBool(c, "stream")
 	if err != nil {
-		return err
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid value for stream: "+c.QueryParam("stream"))
+	}
+
+	customName, err := filenameParam(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidFilename, err.Error())
+	}
+
+	// O corpo é markdown, a menos que ?from= indique outro formato
+	from, err := inputFormatParam(c)
+	if err != nil {
+		logger.Warn("Formato de entrada não suportado", "from", c.QueryParam("from"))
+		return respondError(c, http.StatusBadRequest, codeInvalidInputFormat, err.Error())
+	}
+	if from.Reader == "" {
+		from = converter.InputFormats[0]
+	}
+	opts.From = from.Reader
+
+	// Aceitar apenas conteúdo textual (text/markdown, text/plain, ...)
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	if contentType != "" && !strings.HasPrefix(contentType, "text/") {
+		logger.Warn("Content-Type não suportado", "content_type", contentType)
+		return respondError(c, http.StatusUnsupportedMediaType, codeUnsupportedFile, "Unsupported content type: send the markdown as text/markdown")
+	}
+
+	workDir, cleanup, err := createWorkspace(c.Request().Context(), logger)
+	if err != nil {
+		logger.Error("Erro ao criar diretório de trabalho", "error", err)
+		return respondError(c, http.StatusInternalServerError, codeStorageFailed, "Failed to create working directory")
+	}
+	defer cleanup()
+
+	// Gravar o corpo da requisição em um arquivo temporário com a extensão do formato de entrada
+	mdFile := filepath.Join(workDir, "input"+from.Extensions[0])
+	out, err := os.Create(mdFile)
+	if err != nil {
+		logger.Error("Erro ao criar arquivo markdown", "error", err)
+		return respondError(c, http.StatusInternalServerError, codeStorageFailed, "Failed to save request body")
+	}
+	n, err := io.Copy(out, c.Request().Body)
+	out.Close()
+	if err != nil {
+		logger.Error("Erro ao gravar corpo da requisição", "error", err)
+		return respondError(c, http.StatusInternalServerError, codeStorageFailed, "Failed to save request body")
+	}
+	if n == 0 {
+		return respondError(c, http.StatusBadRequest, codeNoFile, "Empty request body")
+	}
+	if n > maxSourceBytes {
+		logger.Warn("Corpo da requisição excede o limite do arquivo de origem", "size", n, "limit", maxSourceBytes)
+		return respondErrorDetail(c, http.StatusRequestEntityTooLarge, codeSourceTooLarge, "Source file too large",
+			fmt.Sprintf("request body has %d bytes (maximum %d)", n, maxSourceBytes))
+	}
+
+	outputPath := uniqueOutputPath(workDir, "output", format)
+	opts.MediaDir = filepath.Join(workDir, "media")
+	filename := "converted" + format.Extension
+	if customName != "" {
+		filename = withExtension(customName, format.Extension)
+	}
+	logger = logger.With("size", n, "from", opts.From, "format", format.Writer)
+
+	convert := func() ([]string, error) {
+		return s.convertToDOCX(c.Request().Context(), logger, []string{mdFile}, outputPath, opts)
+	}
+	if stream && format.Streamable {
+		convert = func() ([]string, error) { return nil, s.streamConversion(c, logger, []string{mdFile}, opts, filename) }
+	}
+
+	warnings, err := convert()
+	if err != nil {
+		logger.Error("Erro na conversão", "error", err)
+		return respondConversionError(c, err)
+	}
+
+	logger.Info("Conversão concluída com sucesso")
+
+	if c.Response().Committed {
+		return nil
+	}
+	setWarningsHeader(c, warnings)
+	return sendOutput(c, outputPath, filename, format.ContentType)
+}
+
+// respondConversionError traduz um erro de convertToDOCX na resposta HTTP adequada
+func respondConversionError(c echo.Context, err error) error {
+	if requestTimedOut(c) {
+		return respondRequestTimeout(c)
+	}
+	if errors.Is(err, converter.ErrUnsafeOption) {
+		return respondErrorDetail(c, http.StatusBadRequest, codeInvalidParameter, "Invalid option value", err.Error())
+	}
+	if errors.Is(err, errServerBusy) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(conversionWait.Seconds())))
+		return respondError(c, http.StatusServiceUnavailable, codeServerBusy, "Too many conversions in progress, try again later")
+	}
+	if errors.Is(err, converter.ErrTimeout) {
+		return respondError(c, http.StatusGatewayTimeout, codeConversionTimeout, "Conversion timed out after "+pandocTimeout.String())
+	}
+	var failure *converter.Failure
+	if errors.As(err, &failure) {
+		if failure.ExitCode < 0 {
+			return respondErrorDetail(c, http.StatusInternalServerError, codePandocUnavailable, "Pandoc could not be started", err.Error())
+		}
+		// Erros de sintaxe com posição conhecida são culpa do documento, não do servidor
+		if line, column, ok := failure.Location(); ok {
+			return c.JSON(http.StatusUnprocessableEntity, APIError{Code: codeParseError, Message: strings.TrimSpace(failure.Output),
+				ExitCode: failure.ExitCode, Line: line, Column: column})
+		}
+		return c.JSON(http.StatusInternalServerError, APIError{Code: codeConversionFailed, Message: "Conversion failed", Detail: err.Error(), ExitCode: failure.ExitCode})
 	}
-	defer out.Close()
+	return respondErrorDetail(c, http.StatusInternalServerError, codeConversionFailed, "Conversion failed", err.Error())
+}
 
-	_, err = io.Copy(out, src)
-	return err
+// requestLogger retorna um logger com o request_id da requisição atual
+func requestLogger(c echo.Context) *slog.Logger {
+	return slog.Default().With("request_id", c.Response().Header().Get(echo.HeaderXRequestID))
 }
 
-func findMarkdownFile(dir string) (string, error) {
-	var mdFile string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+// sourcePaths retorna os caminhos dos arquivos de origem relativos ao diretório de trabalho, para os logs
+func sourcePaths(workDir string, files []string) []string {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		rel, err := filepath.Rel(workDir, file)
 		if err != nil {
-			return err
+			rel = file
 		}
-		if filepath.Ext(path) == ".md" {
-			mdFile = path
-			return io.EOF // para parar a busca
+		paths[i] = filepath.ToSlash(rel)
+	}
+	return paths
+}
+
+// uniqueOutputPath monta em dir o caminho de um arquivo de saída com o nome base e a extensão do
+// formato, sem colidir com arquivos já existentes: se o nome estiver em uso, acrescenta -2, -3, ...
+func uniqueOutputPath(dir, base string, format converter.OutputFormat) string {
+	path := filepath.Join(dir, base+format.Extension)
+	for i := 2; fileExists(path); i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", base, i, format.Extension))
+	}
+	return path
+}
+
+// fileExists indica se já existe algo em path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// outputFilename deriva o nome do arquivo de saída a partir do nome do arquivo de origem
+// (report.md -> report.docx), removendo componentes de diretório e caracteres de controle
+func outputFilename(source string, format converter.OutputFormat) string {
+	name := filepath.Base(strings.ReplaceAll(source, "\\", "/"))
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	// report.tar.gz -> report
+	if strings.EqualFold(filepath.Ext(name), ".tar") {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return -1
 		}
-		return nil
-	})
+		return r
+	}, name)
 
-	if err != nil && err != io.EOF {
-		return "", fmt.Errorf("error walking the path %s: %v", dir, err)
+	if name == "" || name == "." || name == ".." {
+		name = "converted"
 	}
+	return name + format.Extension
+}
 
-	if mdFile == "" {
-		return "", fmt.Errorf("no markdown file found in zip")
+// filenameParam lê ?filename=, o nome do arquivo devolvido. Retorna "" quando ausente
+func filenameParam(c echo.Context) (string, error) {
+	name := strings.TrimSpace(c.QueryParam("filename"))
+	if name == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(name, `/\`) || strings.ContainsFunc(name, unicode.IsControl) {
+		return "", errors.New("invalid filename: path separators and control characters are not allowed")
+	}
+	if name == "." || name == ".." {
+		return "", errors.New("invalid filename: " + name)
 	}
+	if len(name) > maxFilenameLen {
+		return "", fmt.Errorf("invalid filename: exceeds %d bytes", maxFilenameLen)
+	}
+	return name, nil
+}
 
-	return mdFile, nil
+// withExtension acrescenta ao nome escolhido pelo cliente a extensão do arquivo gerado,
+// a menos que ele já termine com ela (myreport -> myreport.docx)
+func withExtension(name, ext string) string {
+	if strings.EqualFold(filepath.Ext(name), ext) {
+		return name
+	}
+	return name + ext
 }
 
-func convertToDOCX(mdFile, docxPath string) error {
-	cmd := exec.Command("pandoc", "-f", "markdown", "-t", "docx", mdFile, "-o", docxPath, "--extract-media=.")
-	output, err := cmd.CombinedOutput()
+// Tamanho máximo, em bytes, do nome de um arquivo enviado
+const maxFilenameLen = 255
+
+// sanitizeFilename reduz o nome enviado pelo cliente ao seu nome base, removendo
+// componentes de diretório e caracteres de controle. Nomes longos são encurtados
+// preservando a extensão
+func sanitizeFilename(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", errors.New("file name is empty")
+	}
+
+	if len(name) > maxFilenameLen {
+		ext := filepath.Ext(name)
+		if len(ext) >= maxFilenameLen {
+			return "", fmt.Errorf("file name exceeds %d bytes", maxFilenameLen)
+		}
+		base := strings.ToValidUTF8(name[:maxFilenameLen-len(ext)], "")
+		name = base + ext
+	}
+	return name, nil
+}
+
+// Modos de conversão de um zip com vários arquivos markdown
+const (
+	modeSingle = "single" // apenas o primeiro markdown encontrado
+	modeMerge  = "merge"  // todos os markdown concatenados em um único documento
+	modeBatch  = "batch"  // cada markdown convertido separadamente, devolvidos em um zip
+)
+
+// conversionModeParam resolve o modo de conversão pedido em ?mode= (ou ?merge=true)
+func conversionModeParam(c echo.Context) (string, error) {
+	merge, err := queryBool(c, "merge")
 	if err != nil {
-		return fmt.Errorf("pandoc error: %v, output: %s", err, string(output))
+		return "", fmt.Errorf("invalid value for merge: %s", c.QueryParam("merge"))
+	}
+
+	mode := c.QueryParam("mode")
+	switch {
+	case mode == "" && merge:
+		return modeMerge, nil
+	case mode == "":
+		return modeSingle, nil
+	case mode == modeSingle || mode == modeMerge || mode == modeBatch:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid mode: %s (expected single, merge or batch)", mode)
+	}
+}
+
+// inputFormatParam resolve o formato de entrada pedido em ?from=. Sem o parâmetro,
+// retorna um InputFormat vazio e o formato é detectado pela extensão do arquivo
+func inputFormatParam(c echo.Context) (converter.InputFormat, error) {
+	name := c.QueryParam("from")
+	if name == "" {
+		return converter.InputFormat{}, nil
+	}
+	format, ok := converter.InputFormatByReader(name)
+	if !ok {
+		return converter.InputFormat{}, fmt.Errorf("unsupported input format: %s", name)
+	}
+	return format, nil
+}
+
+// outputFormatsParam resolve a lista de formatos pedida em ?formats= (docx,pdf,html),
+// sem repetições. Retorna nil quando o parâmetro não foi enviado
+func outputFormatsParam(c echo.Context) ([]converter.OutputFormat, error) {
+	value := c.QueryParam("formats")
+	if value == "" {
+		return nil, nil
+	}
+	if c.QueryParam("format") != "" {
+		return nil, errors.New("use either format or formats, not both")
+	}
+
+	var formats []converter.OutputFormat
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		format, ok := converter.OutputFormats[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported output format: %s", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+// requirePDFEngine retorna um *APIError 503 se algum dos formatos for PDF e nenhum engine de PDF
+// estiver instalado
+func requirePDFEngine(logger *slog.Logger, formats ...converter.OutputFormat) error {
+	for _, format := range formats {
+		if format.Writer == "pdf" && !pdfEngineAvailable {
+			logger.Warn("Conversão para PDF solicitada sem engine instalado", "engine", pdfEngine)
+			return newAPIError(http.StatusServiceUnavailable, codePDFEngineMissing, "PDF output is unavailable: PDF engine "+pdfEngine+" is not installed", "")
+		}
 	}
 	return nil
 }
-func unzipFile(src, dest string) error {
-	log.Printf("Iniciando extração do arquivo: %s para %s", src, dest)
 
-	r, err := zip.OpenReader(src)
+// outputFormatParam resolve o formato pedido em ?format=, usando fallback por padrão
+func outputFormatParam(c echo.Context, fallback string) (converter.OutputFormat, bool) {
+	name := c.QueryParam("format")
+	if name == "" {
+		name = fallback
+	}
+	format, ok := converter.OutputFormats[name]
+	return format, ok
+}
+
+// defaultOutputFormat retorna o formato usado sem ?format=: gfm para um .docx enviado (ou
+// ?from=docx), que não faria sentido converter para docx de novo, e docx para as demais entradas
+func defaultOutputFormat(c echo.Context) string {
+	if c.QueryParam("from") == "docx" {
+		return "gfm"
+	}
+	if file, err := formUpload(c); err == nil && strings.EqualFold(filepath.Ext(file.Filename), ".docx") {
+		return "gfm"
+	}
+	return "docx"
+}
+
+// convertToDOCX executa o pandoc sobre os arquivos markdown informados, respeitando o limite de
+// conversões simultâneas e registrando as métricas e o span da conversão, filho do span em ctx.
+// Quando há mais de um arquivo, o pandoc os concatena em um único documento. Retorna os avisos
+// que o pandoc escreveu em stderr.
+func (s *server) convertToDOCX(ctx context.Context, logger *slog.Logger, mdFiles []string, outputPath string, opts converter.Options) ([]string, error) {
+	release, err := acquireConversionSlot()
 	if err != nil {
-		log.Printf("Erro ao abrir o arquivo zip: %v", err)
-		return err
+		conversionsTotal.WithLabelValues(opts.Format.Writer, conversionStatus(err)).Inc()
+		return nil, err
+	}
+	defer release()
+
+	// O pandoc é encerrado no shutdown (conversionCtx) ou quando ctx termina, como no REQUEST_TIMEOUT
+	_, span := startSpan(ctx, "pandoc-convert", attribute.String("format", opts.Format.Writer),
+		attribute.String("from", opts.From), attribute.Int("files", len(mdFiles)))
+	runCtx, cancel := context.WithCancel(trace.ContextWithSpan(conversionCtx, span))
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	finish := instrumentConversion(opts.Format.Writer)
+	warnings, err := s.pandoc().Convert(runCtx, logger, mdFiles, outputPath, opts)
+	finish(err)
+	if info, statErr := os.Stat(outputPath); err == nil && statErr == nil {
+		span.SetAttributes(attribute.Int64("output.bytes", info.Size()))
+	}
+	endSpan(span, err)
+	return warnings, err
+}
+
+// pandoc monta o conversor com o runner do servidor e a configuração lida do ambiente
+func (s *server) pandoc() *converter.Pandoc {
+	return &converter.Pandoc{
+		Runner:       s.runner,
+		PDFEngine:    pdfEngine,
+		PDFFallbacks: pdfEngineFallbacks,
+		Filters:      pandocFilters,
+		Defaults:     pandocDefaults,
+		Timeout:      pandocTimeout,
 	}
-	defer r.Close()
+}
+
+// sendOutput envia o arquivo convertido como anexo com o Content-Type do registro de formatos,
+// em vez do tipo adivinhado pela extensão, que nem sempre é conhecido (docx, epub, odt)
+func sendOutput(c echo.Context, path, filename, contentType string) error {
+	setPandocVersionHeader(c)
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	return c.Attachment(path, filename)
+}
+
+// outputPayload é a resposta de ?response=json: o arquivo convertido codificado em base64
+type outputPayload struct {
+	Filename      string `json:"filename"`
+	Mime          string `json:"mime"`
+	ContentBase64 string `json:"content_base64"`
+}
 
-	if err := os.MkdirAll(dest, 0755); err != nil {
-		log.Printf("Erro ao criar o diretório de destino: %v", err)
+// sendOutputJSON envia o arquivo convertido em base64 dentro de um JSON, para clientes que
+// não conseguem tratar downloads binários
+func sendOutputJSON(c echo.Context, path, filename, contentType string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
 		return err
 	}
+	setPandocVersionHeader(c)
+	return c.JSON(http.StatusOK, outputPayload{
+		Filename:      filename,
+		Mime:          contentType,
+		ContentBase64: base64.StdEncoding.EncodeToString(content),
+	})
+}
 
-	for _, f := range r.File {
-		log.Printf("Extraindo: %s", f.Name)
+// responseModeParam lê ?response=: "file" (padrão) envia o anexo binário e "json" envia o conteúdo em base64
+func responseModeParam(c echo.Context) (bool, error) {
+	switch mode := c.QueryParam("response"); mode {
+	case "", "file":
+		return false, nil
+	case "json":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid value for response: %s (expected file or json)", mode)
+	}
+}
 
-		// Garantir que o caminho de destino esteja dentro do diretório de destino
-		filePath := filepath.Join(dest, f.Name)
-		if !strings.HasPrefix(filePath, filepath.Clean(dest)+string(os.PathSeparator)) {
-			return fmt.Errorf("arquivo inválido detectado: %s", f.Name)
-		}
+// setPandocVersionHeader envia no cabeçalho X-Pandoc-Version a versão do pandoc que gerou o arquivo,
+// para relacionar diferenças na saída com versões do pandoc
+func setPandocVersionHeader(c echo.Context) {
+	if version, ok := pandocReady(); ok {
+		c.Response().Header().Set("X-Pandoc-Version", version)
+	}
+}
+
+// Tamanho máximo do cabeçalho X-Pandoc-Warnings
+const maxWarningsHeaderLen = 4096
+
+// setWarningsHeader envia os avisos do pandoc no cabeçalho X-Pandoc-Warnings, separados por "; "
+func setWarningsHeader(c echo.Context, warnings []string) {
+	if len(warnings) == 0 {
+		return
+	}
+	value := strings.Join(warnings, "; ")
+	if len(value) > maxWarningsHeaderLen {
+		value = value[:maxWarningsHeaderLen] + "..."
+	}
+	c.Response().Header().Set("X-Pandoc-Warnings", value)
+}
 
-		if f.FileInfo().IsDir() {
-			log.Printf("Criando diretório: %s", filePath)
-			os.MkdirAll(filePath, os.ModePerm)
+// acquireConversionSlot aguarda uma vaga no semáforo de conversões e retorna a função que a libera
+func acquireConversionSlot() (func(), error) {
+	select {
+	case conversionSlots <- struct{}{}:
+		return func() { <-conversionSlots }, nil
+	case <-time.After(conversionWait):
+		return nil, errServerBusy
+	}
+}
+
+// checkPandoc verifica se o pandoc pode ser executado e guarda a versão encontrada
+func checkPandoc() error {
+	version, err := pandocVersion()
+	if err != nil {
+		return fmt.Errorf("Pandoc não está instalado ou não é executável: %w", err)
+	}
+	slog.Info("Versão do Pandoc", "version", version)
+	detectedPandocVersion.Store(strings.TrimPrefix(version, "pandoc "))
+	return nil
+}
+
+// waitForPandoc repete checkPandoc a cada interval até encontrar o pandoc, encerrando o modo degradado
+func waitForPandoc(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := checkPandoc(); err != nil {
+			slog.Debug("Pandoc ainda indisponível", "error", err)
 			continue
 		}
+		slog.Info("Pandoc encontrado, saindo do modo degradado")
+		return
+	}
+}
 
-		if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-			log.Printf("Erro ao criar diretório para arquivo: %v", err)
-			return err
+// requirePandoc responde 503 às rotas de conversão enquanto o servidor estiver em modo degradado
+func requirePandoc(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if _, ok := pandocReady(); !ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(pandocRetryInterval.Seconds())))
+			return respondError(c, http.StatusServiceUnavailable, codePandocUnavailable, "Pandoc is not installed or not executable on the server, try again later")
 		}
+		return next(c)
+	}
+}
 
-		dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-		if err != nil {
-			log.Printf("Erro ao criar arquivo: %v", err)
-			return err
+// checkPDFEngines verifica quais engines de PDF estão instalados. O configurado vem primeiro; se
+// ele faltar, o primeiro alternativo instalado assume o lugar dele. Diferente do pandoc, a
+// ausência de todos não impede o servidor de subir: apenas as conversões para PDF ficam indisponíveis.
+func checkPDFEngines(configured string, fallbacks []string) (engine string, installed []string, ok bool) {
+	for _, name := range append([]string{configured}, fallbacks...) {
+		if slices.Contains(installed, name) {
+			continue
 		}
-
-		srcFile, err := f.Open()
+		path, err := exec.LookPath(name)
 		if err != nil {
-			log.Printf("Erro ao abrir arquivo dentro do zip: %v", err)
-			dstFile.Close()
-			return err
+			if name == configured {
+				slog.Warn("Engine de PDF não encontrado", "engine", name, "error", err)
+			}
+			continue
 		}
+		installed = append(installed, name)
+		slog.Info("Engine de PDF", "engine", name, "path", path)
+	}
 
-		_, err = io.Copy(dstFile, srcFile)
-		srcFile.Close()
-		dstFile.Close()
+	if len(installed) == 0 {
+		slog.Warn("Nenhum engine de PDF encontrado, conversões para PDF ficarão indisponíveis", "engines", append([]string{configured}, fallbacks...))
+		return configured, nil, false
+	}
+	if installed[0] != configured {
+		slog.Warn("Usando engine de PDF alternativo", "configured", configured, "engine", installed[0])
+	}
+	return installed[0], installed[1:], true
+}
 
+// checkPandocFilters resolve os filtros configurados em PANDOC_FILTERS para caminhos absolutos,
+// já que o pandoc roda no diretório dos arquivos de origem. Filtros não encontrados são
+// ignorados com um aviso, para não derrubar todas as conversões
+func checkPandocFilters(filters []string) []string {
+	var resolved []string
+	for _, filter := range filters {
+		var path string
+		var err error
+		if strings.HasSuffix(filter, ".lua") {
+			// Filtros Lua são scripts lidos pelo próprio pandoc
+			if path, err = filepath.Abs(filter); err == nil {
+				_, err = os.Stat(path)
+			}
+		} else {
+			path, err = exec.LookPath(filter)
+			if err == nil {
+				path, err = filepath.Abs(path)
+			}
+		}
 		if err != nil {
-			log.Printf("Erro ao copiar conteúdo do arquivo: %v", err)
-			return err
+			slog.Warn("Filtro do pandoc não encontrado, ignorando", "filter", filter, "error", err)
+			continue
 		}
+		slog.Info("Filtro do pandoc", "filter", filter, "path", path)
+		resolved = append(resolved, path)
 	}
+	return resolved
+}
 
-	log.Printf("Extração concluída com sucesso")
-	return nil
+// checkPandocDefaults confere se o arquivo de defaults existe e pode ser lido, e retorna seu caminho
+// absoluto, já que o pandoc roda no diretório de trabalho de cada requisição
+func checkPandocDefaults(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s é um diretório", path)
+	}
+	return path, nil
 }
 
-func checkPandoc() error {
-	cmd := exec.Command("pandoc", "--version")
+// pandocVersion executa "pandoc --version" e retorna a primeira linha da saída
+func pandocVersion() (string, error) {
+	cmd := exec.Command(pandocBin, "--version")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("Erro ao verificar versão do Pandoc: %v", err)
-		return fmt.Errorf("Pandoc não está instalado ou não é executável: %w", err)
+		return "", err
 	}
-	log.Printf("Versão do Pandoc: %s", string(output))
-	return nil
+	version, _, _ := strings.Cut(string(output), "\n")
+	return strings.TrimSpace(version), nil
+}
+
+// formatInfo descreve um formato de saída na resposta de /formats
+type formatInfo struct {
+	Key       string `json:"key"`
+	Label     string `json:"label"`
+	Extension string `json:"extension"`
+	MIME      string `json:"mime"`
+}
+
+// handleFormats lista os formatos de saída suportados, a partir do mesmo registro usado em ?format=
+func handleFormats(c echo.Context) error {
+	formats := make([]formatInfo, 0, len(converter.OutputFormats))
+	for key, format := range converter.OutputFormats {
+		formats = append(formats, formatInfo{
+			Key:       key,
+			Label:     format.Label,
+			Extension: format.Extension,
+			MIME:      format.ContentType,
+		})
+	}
+	sort.Slice(formats, func(i, j int) bool { return formats[i].Key < formats[j].Key })
+
+	return c.JSON(http.StatusOK, formats)
+}
+
+// handleHealth informa se o servidor consegue executar o pandoc. Em modo degradado (pandoc não
+// encontrado na inicialização) responde 503 com status "degraded".
+// Com ?format=pdf o health check também falha quando o engine de PDF não está instalado.
+func handleHealth(c echo.Context) error {
+	detected, ok := pandocReady()
+	if !ok {
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "degraded", "pandoc": "unavailable"})
+	}
+
+	version, err := pandocVersion()
+	if err != nil {
+		slog.Warn("Health check falhou", "error", err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"status": "unavailable"})
+	}
+
+	pdfStatus := "ok"
+	if !pdfEngineAvailable {
+		pdfStatus = "unavailable"
+	}
+	// pandoc_version é a versão detectada na inicialização, a mesma enviada em X-Pandoc-Version
+	payload := map[string]string{"status": "ok", "pandoc": version, "pandoc_version": detected, "pdf_engine": pdfStatus}
+	if c.QueryParam("format") == "pdf" && !pdfEngineAvailable {
+		payload["status"] = "unavailable"
+		return c.JSON(http.StatusServiceUnavailable, payload)
+	}
+	return c.JSON(http.StatusOK, payload)
+}
+
+// handleVersion informa o que está implantado: a versão da aplicação, a do Go usado na
+// compilação e a do pandoc detectado, para anexar a chamados de suporte
+func handleVersion(c echo.Context) error {
+	pandoc, ok := pandocReady()
+	if !ok {
+		pandoc = "unavailable"
+	}
+	return c.JSON(http.StatusOK, map[string]string{"version": buildVersion, "go_version": runtime.Version(), "pandoc_version": pandoc})
+}
+
+// getEnvDuration lê uma duração (ex: "30s", "1h") de uma variável de ambiente, usando o padrão se ausente ou inválida
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		slog.Warn("Valor inválido na variável de ambiente, usando padrão", "key", key, "value", value, "default", fallback.String())
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool lê uma variável de ambiente booleana, usando fallback se estiver vazia ou inválida
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Valor inválido na variável de ambiente, usando padrão", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
+// queryBool interpreta um parâmetro booleano da query string; ausente equivale a false
+func queryBool(c echo.Context, name string) (bool, error) {
+	return queryBoolDefault(c, name, false)
+}
+
+// queryBoolDefault interpreta um parâmetro booleano da query string; ausente equivale a fallback
+func queryBoolDefault(c echo.Context, name string, fallback bool) (bool, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// listenAddr resolve o endereço do servidor: LISTEN_ADDR tem precedência sobre PORT,
+// que é a variável injetada por plataformas como Heroku e Cloud Run. O padrão é :8080.
+func listenAddr() string {
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		return addr
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+// getEnv lê uma variável de ambiente, usando o padrão se ausente
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvList lê uma lista separada por vírgulas de uma variável de ambiente, usando o padrão se ausente
+func getEnvList(key string, fallback []string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 0 {
+		return fallback
+	}
+	return values
+}
+
+// getEnvInt64 lê um inteiro positivo de uma variável de ambiente, usando o padrão se ausente ou inválido
+func getEnvInt64(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		slog.Warn("Valor inválido na variável de ambiente, usando padrão", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return n
 }
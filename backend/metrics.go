@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Métricas das conversões expostas em /metrics
+var (
+	conversionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "conversions_total",
+		Help: "Total de conversões por formato de saída e resultado.",
+	}, []string{"format", "status"})
+
+	conversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "conversion_duration_seconds",
+		Help:    "Duração das execuções do pandoc.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"format"})
+
+	conversionsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "conversions_in_flight",
+		Help: "Número de processos do pandoc em execução.",
+	})
+
+	jobQueueLength = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "job_queue_length",
+		Help: "Jobs assíncronos aguardando um worker livre.",
+	}, func() float64 { return float64(jobs.queue.Len()) })
+
+	jobQueueCapacity = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "job_queue_capacity",
+		Help: "Jobs assíncronos que podem aguardar na fila antes de novas submissões receberem 503.",
+	}, func() float64 { return float64(jobs.queue.Cap()) })
+
+	cacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "conversion_cache_requests_total",
+		Help: "Consultas ao cache de conversões por resultado (hit ou miss).",
+	}, []string{"result"})
+)
+
+// instrumentConversion marca o início de uma execução do pandoc e retorna a função
+// que registra seu resultado nas métricas
+func instrumentConversion(format string) func(err error) {
+	start := time.Now()
+	conversionsInFlight.Inc()
+
+	return func(err error) {
+		conversionsInFlight.Dec()
+		conversionDuration.WithLabelValues(format).Observe(time.Since(start).Seconds())
+		conversionsTotal.WithLabelValues(format, conversionStatus(err)).Inc()
+	}
+}
+
+// conversionStatus classifica o resultado de uma conversão para o rótulo status
+func conversionStatus(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, errServerBusy):
+		return "busy"
+	case errors.Is(err, converter.ErrTimeout):
+		return "timeout"
+	default:
+		return "error"
+	}
+}
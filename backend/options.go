@@ -0,0 +1,396 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// Profundidade padrão do sumário, a mesma usada pelo pandoc
+const defaultTOCDepth = 3
+
+// conversionOptionsFromRequest lê as opções de conversão da requisição:
+//
+//	?toc=true             gera um sumário
+//	?toc_depth=N          níveis de título no sumário (1 a 6, padrão 3)
+//	?number_sections=true numera os títulos, inclusive no sumário
+//	?standalone=true      HTML em um único arquivo, com as imagens embutidas em base64
+//	?dialect=gfm          variante de markdown e extensões do pandoc (markdown+smart-raw_html);
+//	                      padrão markdown, o markdown do pandoc. Não se aplica a outros formatos de entrada
+//	title, author, date   campos do formulário (ou da query) que sobrescrevem o front matter
+func conversionOptionsFromRequest(c echo.Context, format converter.OutputFormat) (converter.Options, error) {
+	opts := converter.Options{Format: format, TOCDepth: defaultTOCDepth}
+
+	toc, err := queryBool(c, "toc")
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for toc: %s", c.QueryParam("toc"))
+	}
+	opts.TOC = toc
+
+	if value := c.QueryParam("toc_depth"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 || depth > 6 {
+			return opts, fmt.Errorf("toc_depth must be an integer between 1 and 6")
+		}
+		opts.TOCDepth = depth
+	}
+
+	numberSections, err := queryBool(c, "number_sections")
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for number_sections: %s", c.QueryParam("number_sections"))
+	}
+	opts.NumberSections = numberSections
+
+	standalone, err := queryBool(c, "standalone")
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for standalone: %s", c.QueryParam("standalone"))
+	}
+	// Só vale para HTML (ver optionsForFormat); os demais formatos já empacotam as imagens no próprio arquivo
+	opts.Standalone = standalone
+
+	extractMedia, err := queryBoolDefault(c, "extract_media", true)
+	if err != nil {
+		return opts, fmt.Errorf("invalid value for extract_media: %s", c.QueryParam("extract_media"))
+	}
+	opts.NoExtractMedia = !extractMedia
+
+	if value := c.QueryParam("dialect"); value != "" {
+		dialect, err := converter.ParseDialect(value)
+		if err != nil {
+			return opts, err
+		}
+		opts.Dialect = dialect
+	}
+
+	if value := c.QueryParam("highlight"); value != "" {
+		highlight, err := converter.ParseHighlightStyle(value)
+		if err != nil {
+			return opts, err
+		}
+		opts.Highlight = highlight
+	}
+
+	if value := c.QueryParam("math"); value != "" {
+		math, err := converter.ParseMathRenderer(value)
+		if err != nil {
+			return opts, err
+		}
+		opts.Math = math
+	}
+
+	// ?var=chave=valor, repetido para cada variável de template
+	for _, param := range c.QueryParams()["var"] {
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return opts, fmt.Errorf("invalid var %q: expected key=value", param)
+		}
+		if err := setVariable(&opts, key, value); err != nil {
+			return opts, err
+		}
+	}
+
+	for _, field := range converter.MetadataFields {
+		if value := strings.TrimSpace(c.FormValue(field)); value != "" {
+			if opts.Metadata == nil {
+				opts.Metadata = make(map[string]string)
+			}
+			opts.Metadata[field] = value
+		}
+	}
+
+	return opts, nil
+}
+
+// setVariable valida e acrescenta uma variável de template às opções
+func setVariable(opts *converter.Options, key, value string) error {
+	if err := converter.CheckVariable(key, value); err != nil {
+		return err
+	}
+	if _, exists := opts.Variables[key]; !exists && len(opts.Variables) >= converter.MaxVariables {
+		return fmt.Errorf("too many variables (maximum %d)", converter.MaxVariables)
+	}
+	if opts.Variables == nil {
+		opts.Variables = make(map[string]string)
+	}
+	opts.Variables[key] = value
+	return nil
+}
+
+// setVariables acrescenta às opções as variáveis enviadas no corpo JSON, que têm precedência
+// sobre as de ?var=
+func setVariables(opts *converter.Options, variables map[string]string) error {
+	for _, key := range slices.Sorted(maps.Keys(variables)) {
+		if err := setVariable(opts, key, variables[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionsForFormat ajusta as opções para um formato de saída: o documento de referência só vale
+// para o formato do mesmo tipo (DOCX ou PPTX), ?standalone só para HTML, a capa e os metadados do EPUB só para EPUB e o template
+// do zip só para o writer correspondente
+func optionsForFormat(logger *slog.Logger, opts converter.Options, format converter.OutputFormat, extractPath string) (converter.Options, error) {
+	opts.Format = format
+	opts.Standalone = opts.Standalone && format.Writer == "html"
+	if opts.ReferenceDoc != "" && !strings.EqualFold(filepath.Ext(opts.ReferenceDoc), format.Extension) {
+		logger.Info("Ignorando documento de referência", "format", format.Writer)
+		opts.ReferenceDoc = ""
+	}
+	if format.Writer != "epub" {
+		if opts.EpubCover != "" {
+			logger.Info("Ignorando capa do EPUB", "cover", opts.EpubCover, "format", format.Writer)
+		}
+		if opts.EpubMetadata != "" {
+			logger.Info("Ignorando metadados do EPUB", "metadata", opts.EpubMetadata, "format", format.Writer)
+		}
+		opts.EpubCover, opts.EpubMetadata = "", ""
+	}
+
+	if extractPath == "" {
+		return opts, nil
+	}
+
+	// Template do pandoc (template.html, template.latex) para controlar o HTML ou o LaTeX gerado
+	template, skipped, err := findTemplate(extractPath, format)
+	if err != nil {
+		return opts, err
+	}
+	if template != "" {
+		logger.Info("Usando template", "template", template, "format", format.Writer)
+	} else if skipped != "" {
+		logger.Info("Ignorando template que não se aplica ao formato", "template", skipped, "format", format.Writer)
+	}
+	opts.Template = template
+	return opts, nil
+}
+
+// referenceDocType descreve um tipo de documento de referência aceito em --reference-doc
+type referenceDocType struct {
+	Writer string // writer do pandoc que usa o documento
+	Name   string // nome procurado dentro do zip
+	Marker string // entrada obrigatória do arquivo, que identifica o tipo
+}
+
+// Documentos de referência aceitos: estilos do DOCX e layouts de slide do PPTX
+var referenceDocTypes = []referenceDocType{
+	{Writer: "docx", Name: "reference.docx", Marker: "word/document.xml"},
+	{Writer: "pptx", Name: "reference.pptx", Marker: "ppt/presentation.xml"},
+}
+
+// Diretório com os documentos de referência mantidos pelos administradores, configurável via
+// TEMPLATES_DIR: ?reference=corporate usa corporate.docx (ou corporate.pptx) desse diretório
+var templatesDir string
+
+// Nomes aceitos em ?reference=, sem caminho nem extensão
+var referenceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// referenceTypesFor ordena os tipos de documento de referência com o do writer informado primeiro
+func referenceTypesFor(writer string) []referenceDocType {
+	var types []referenceDocType
+	for _, docType := range referenceDocTypes {
+		if docType.Writer == writer {
+			types = append([]referenceDocType{docType}, types...)
+		} else {
+			types = append(types, docType)
+		}
+	}
+	return types
+}
+
+// sharedReferenceDoc localiza em templatesDir o documento de referência pedido em ?reference=,
+// dando preferência ao do writer informado
+func sharedReferenceDoc(name, writer string) (string, error) {
+	if templatesDir == "" {
+		return "", errors.New("shared reference documents are not configured on this server")
+	}
+	if !referenceNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid reference name %q: use letters, digits, - and _", name)
+	}
+	for _, docType := range referenceTypesFor(writer) {
+		path := filepath.Join(templatesDir, name+filepath.Ext(docType.Name))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := validateReferenceDoc(path, docType); err != nil {
+			return "", err
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("reference document %q not found", name)
+}
+
+// findReferenceDoc localiza o documento de referência da requisição: primeiro no campo
+// "reference" do formulário, depois em ?reference=, entre os documentos compartilhados de
+// TEMPLATES_DIR, e por fim, se searchDir não for vazio, dentro dos arquivos extraídos,
+// dando preferência ao documento do writer informado. O tipo de um documento enviado é
+// identificado pelo conteúdo e define sua extensão. Retorna "" quando nenhum foi enviado.
+func findReferenceDoc(c echo.Context, workDir, searchDir, writer string) (string, error) {
+	var path string
+
+	if file, err := c.FormFile("reference"); err == nil {
+		// Um diretório próprio, para não sobrescrever o arquivo enviado (que pode se chamar reference.docx).
+		// O nome é fixo para que os argumentos do pandoc, e a chave de cache, não mudem a cada requisição;
+		// os.Mkdir falha em vez de reaproveitar um upload com esse nome
+		dir := filepath.Join(workDir, "reference-doc")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return "", err
+		}
+		uploaded := filepath.Join(dir, "reference")
+		if err := converter.SaveUploadedFile(file, uploaded); err != nil {
+			return "", err
+		}
+		docType, err := detectReferenceDoc(uploaded)
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, docType.Name)
+		if err := os.Rename(uploaded, path); err != nil {
+			return "", err
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) {
+		return "", err
+	} else if name := c.QueryParam("reference"); name != "" {
+		if path, err = sharedReferenceDoc(name, writer); err != nil {
+			return "", err
+		}
+	} else if searchDir != "" {
+		for _, docType := range referenceTypesFor(writer) {
+			found, err := converter.FindNamedFile(searchDir, docType.Name)
+			if err != nil {
+				return "", err
+			}
+			if found != "" {
+				if err := validateReferenceDoc(found, docType); err != nil {
+					return "", err
+				}
+				path = found
+				break
+			}
+		}
+	}
+
+	if path == "" {
+		return "", nil
+	}
+	requestLogger(c).Info("Usando documento de referência", "path", path)
+	return path, nil
+}
+
+// findCitationFiles localiza no diretório extraído um arquivo .bib e, opcionalmente, um estilo .csl
+func findCitationFiles(dir string) (bibliography, csl string, err error) {
+	if bibliography, err = converter.FindFileWithExt(dir, ".bib"); err != nil || bibliography == "" {
+		return "", "", err
+	}
+	if csl, err = converter.FindFileWithExt(dir, ".csl"); err != nil {
+		return "", "", err
+	}
+	return bibliography, csl, nil
+}
+
+// Nomes da imagem de capa do EPUB procurados no zip, em ordem de preferência
+var epubCoverNames = []string{"cover.png", "cover.jpg", "cover.jpeg"}
+
+// Nome do arquivo de metadados Dublin Core do EPUB procurado no zip
+const epubMetadataName = "metadata.xml"
+
+// findEpubFiles localiza no diretório extraído a imagem de capa e os metadados do EPUB
+func findEpubFiles(dir string) (cover, metadata string, err error) {
+	for _, name := range epubCoverNames {
+		if cover, err = converter.FindNamedFile(dir, name); err != nil || cover != "" {
+			break
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if metadata, err = converter.FindNamedFile(dir, epubMetadataName); err != nil {
+		return "", "", err
+	}
+	return cover, metadata, nil
+}
+
+// Templates do pandoc procurados no zip e os writers a que cada um se aplica
+var templateFiles = []struct {
+	Name    string
+	Writers []string
+}{
+	{Name: "template.html", Writers: []string{"html"}},
+	{Name: "template.latex", Writers: []string{"latex", "pdf"}},
+	{Name: "template.tex", Writers: []string{"latex", "pdf"}},
+}
+
+// Engines de PDF que passam pelo LaTeX e, portanto, usam um template LaTeX
+var latexEngines = map[string]bool{"pdflatex": true, "xelatex": true, "lualatex": true, "tectonic": true, "latexmk": true}
+
+// findTemplate procura no diretório extraído um template do pandoc. Retorna o caminho do
+// template se ele se aplicar ao formato de saída; caso contrário, retorna em skipped o
+// template encontrado que foi ignorado
+func findTemplate(dir string, format converter.OutputFormat) (path, skipped string, err error) {
+	for _, tmpl := range templateFiles {
+		found, err := converter.FindNamedFile(dir, tmpl.Name)
+		if err != nil {
+			return "", "", err
+		}
+		if found == "" {
+			continue
+		}
+
+		applies := slices.Contains(tmpl.Writers, format.Writer)
+		if format.Writer == "pdf" && !latexEngines[pdfEngine] {
+			applies = false
+		}
+		if !applies {
+			skipped = found
+			continue
+		}
+
+		// Conferir se o template pode ser lido antes de entregá-lo ao pandoc
+		f, err := os.Open(found)
+		if err != nil {
+			return "", "", fmt.Errorf("template %s is not readable: %w", tmpl.Name, err)
+		}
+		f.Close()
+		return found, "", nil
+	}
+	return "", skipped, nil
+}
+
+// detectReferenceDoc identifica pelo conteúdo se o arquivo é um DOCX ou um PPTX
+func detectReferenceDoc(path string) (referenceDocType, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return referenceDocType{}, errors.New("reference document is not a valid docx or pptx file")
+	}
+	defer r.Close()
+
+	for _, docType := range referenceDocTypes {
+		for _, f := range r.File {
+			if f.Name == docType.Marker {
+				return docType, nil
+			}
+		}
+	}
+	return referenceDocType{}, errors.New("reference document is not a valid docx or pptx file: missing word/document.xml or ppt/presentation.xml")
+}
+
+// validateReferenceDoc verifica se o arquivo é de fato do tipo indicado pelo nome: um zip contendo a entrada Marker
+func validateReferenceDoc(path string, docType referenceDocType) error {
+	detected, err := detectReferenceDoc(path)
+	if err != nil || detected.Writer != docType.Writer {
+		return fmt.Errorf("reference document is not a valid %s file: missing %s", docType.Writer, docType.Marker)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// Quantidade padrão de jobs que aguardam um worker livre, configurável via JOB_QUEUE_DEPTH
+const defaultJobQueueDepth = 100
+
+// errQueueFull indica que a fila de jobs assíncronos está cheia
+var errQueueFull = errors.New("fila de jobs cheia")
+
+// JobQueue executa os jobs assíncronos com um número fixo de workers. Os jobs aguardam em uma
+// fila limitada; com a fila cheia, Submit os recusa em vez de acumular goroutines. Os workers
+// continuam disputando com as requisições síncronas as vagas de MAX_CONCURRENT_CONVERSIONS
+type JobQueue struct {
+	workers int
+	tasks   chan func()
+	start   sync.Once
+}
+
+// NewJobQueue cria uma fila com workers workers e espaço para depth jobs aguardando.
+// Os workers só são iniciados no primeiro Submit
+func NewJobQueue(workers, depth int) *JobQueue {
+	return &JobQueue{workers: max(workers, 1), tasks: make(chan func(), max(depth, 1))}
+}
+
+// Submit coloca task na fila, ou retorna errQueueFull se não houver espaço
+func (q *JobQueue) Submit(task func()) error {
+	q.start.Do(func() {
+		for range q.workers {
+			go q.work()
+		}
+	})
+
+	select {
+	case q.tasks <- task:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// work executa os jobs da fila, um de cada vez
+func (q *JobQueue) work() {
+	for task := range q.tasks {
+		task()
+	}
+}
+
+// Len retorna quantos jobs aguardam um worker
+func (q *JobQueue) Len() int {
+	return len(q.tasks)
+}
+
+// Cap retorna quantos jobs podem aguardar na fila
+func (q *JobQueue) Cap() int {
+	return cap(q.tasks)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+)
+
+// Requisições de conversão permitidas por minuto para cada IP, configurável via RATE_LIMIT_PER_MINUTE
+const defaultRateLimitPerMinute = 60
+
+// rateLimit limita quantas conversões cada IP pode pedir por minuto. É independente do
+// semáforo de conversões: este limita a vazão de cada cliente, aquele o paralelismo total
+func rateLimit(perMinute int64) echo.MiddlewareFunc {
+	// Tempo para o balde de um cliente ganhar uma nova vaga
+	retryAfter := strconv.Itoa(int(math.Ceil(60 / float64(perMinute))))
+
+	store := middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+		Rate:      rate.Limit(float64(perMinute) / 60),
+		Burst:     int(perMinute),
+		ExpiresIn: 3 * time.Minute,
+	})
+
+	return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: store,
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			requestLogger(c).Warn("Limite de requisições excedido", "client", identifier)
+			c.Response().Header().Set("Retry-After", retryAfter)
+			return respondError(c, http.StatusTooManyRequests, codeRateLimited, "Too many requests, try again later")
+		},
+	})
+}
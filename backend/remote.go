@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// Tempo máximo padrão para baixar um documento remoto, configurável via REMOTE_FETCH_TIMEOUT
+const defaultRemoteFetchTimeout = 30 * time.Second
+
+// Quantidade máxima de redirecionamentos seguidos ao baixar um documento remoto
+const maxRemoteRedirects = 5
+
+// Hosts de onde /convert/url pode baixar documentos, configuráveis via REMOTE_ALLOWED_HOSTS
+// (ex.: raw.githubusercontent.com,gitlab.com). Vazia, qualquer host público é aceito
+var remoteAllowedHosts []string
+
+// Cliente HTTP usado para baixar documentos remotos
+var remoteClient = newRemoteClient(defaultRemoteFetchTimeout)
+
+// errHostNotAllowed indica que a URL aponta para um host fora da lista permitida ou para um endereço interno
+var errHostNotAllowed = errors.New("host não permitido")
+
+// remoteRequest é o corpo de POST /convert/url
+type remoteRequest struct {
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	From   string `json:"from"`
+
+	// Variáveis de template, somadas às de ?var=
+	Variables map[string]string `json:"variables"`
+}
+
+// newRemoteClient cria o cliente HTTP dos downloads remotos. A conexão a endereços internos
+// (loopback, rede privada, link-local) é recusada na hora da discagem, já resolvido o DNS, para
+// evitar SSRF. Isso vale também para os hosts de REMOTE_ALLOWED_HOSTS, que só restringem os nomes
+// aceitos (veja checkRemoteURL): um host permitido ainda pode resolver para um endereço interno
+func newRemoteClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w: endereço interno %s", errHostNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRemoteRedirects {
+				return fmt.Errorf("mais de %d redirecionamentos", maxRemoteRedirects)
+			}
+			return checkRemoteURL(req.URL)
+		},
+	}
+}
+
+// normalizeHosts converte a lista de hosts permitidos para minúsculas
+func normalizeHosts(hosts []string) []string {
+	normalized := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		normalized = append(normalized, strings.ToLower(host))
+	}
+	return normalized
+}
+
+// publicIP indica se o endereço é roteável na internet
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// checkRemoteURL aceita apenas URLs http ou https para hosts da lista permitida, quando configurada
+func checkRemoteURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q: use http or https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	if len(remoteAllowedHosts) > 0 && !slices.Contains(remoteAllowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("%w: %s", errHostNotAllowed, u.Hostname())
+	}
+	return nil
+}
+
+// handleConvertURL baixa um documento de uma URL e o converte, como se tivesse sido enviado em /convert/raw.
+// Opções de conversão (toc, standalone, ...) continuam vindo da query string
+func (s *server) handleConvertURL(c echo.Context) error {
+	logger := requestLogger(c)
+	logger.Info("Iniciando conversão de documento remoto")
+
+	var req remoteRequest
+	if err := c.Bind(&req); err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, "Invalid request body: expected JSON with url and format")
+	}
+
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || req.URL == "" {
+		return respondError(c, http.StatusBadRequest, codeInvalidURL, "Invalid or missing url")
+	}
+	if err := checkRemoteURL(u); err != nil {
+		logger.Warn("URL recusada", "url", u.Redacted(), "error", err)
+		if errors.Is(err, errHostNotAllowed) {
+			return respondError(c, http.StatusForbidden, codeHostNotAllowed, "Host is not allowed: "+u.Hostname())
+		}
+		return respondError(c, http.StatusBadRequest, codeInvalidURL, err.Error())
+	}
+	logger = logger.With("url", u.Redacted())
+
+	if req.Format == "" {
+		req.Format = "docx"
+	}
+	format, ok := converter.OutputFormats[req.Format]
+	if !ok {
+		return respondError(c, http.StatusBadRequest, codeInvalidFormat, "Unsupported output format: "+req.Format)
+	}
+	if err := requirePDFEngine(logger, format); err != nil {
+		return respondAPIError(c, err)
+	}
+
+	opts, err := conversionOptionsFromRequest(c, format)
+	if err == nil {
+		err = setVariables(&opts, req.Variables)
+	}
+	if err != nil {
+		logger.Warn("Opções de conversão inválidas", "error", err)
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+
+	customName, err := filenameParam(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidFilename, err.Error())
+	}
+
+	// O formato de entrada vem do campo "from" ou da extensão da URL; o padrão é markdown
+	from := converter.InputFormats[0]
+	if req.From != "" {
+		var ok bool
+		if from, ok = converter.InputFormatByReader(req.From); !ok {
+			return respondError(c, http.StatusBadRequest, codeInvalidInputFormat, "unsupported input format: "+req.From)
+		}
+	} else if detected, ok := converter.InputFormatForFile(u.Path, converter.InputFormats); ok {
+		from = detected
+	}
+	opts.From = from.Reader
+
+	workDir, cleanup, err := createWorkspace(c.Request().Context(), logger)
+	if err != nil {
+		logger.Error("Erro ao criar diretório de trabalho", "error", err)
+		return respondError(c, http.StatusInternalServerError, codeStorageFailed, "Failed to create working directory")
+	}
+	defer cleanup()
+
+	srcFile := filepath.Join(workDir, "input"+from.Extensions[0])
+	n, err := downloadRemote(c.Request().Context(), logger, u, srcFile)
+	if err != nil {
+		logger.Warn("Erro ao baixar documento remoto", "error", err)
+		switch {
+		case errors.Is(err, errHostNotAllowed):
+			return respondError(c, http.StatusForbidden, codeHostNotAllowed, "Host is not allowed: "+u.Hostname())
+		case errors.Is(err, errRemoteTooLarge):
+			return respondError(c, http.StatusRequestEntityTooLarge, codeFileTooLarge, "Remote file too large")
+		}
+		return respondErrorDetail(c, http.StatusBadGateway, codeFetchFailed, "Failed to fetch remote document", err.Error())
+	}
+	if n == 0 {
+		return respondError(c, http.StatusBadRequest, codeNoFile, "Remote document is empty")
+	}
+	if n > maxSourceBytes {
+		logger.Warn("Documento remoto excede o limite do arquivo de origem", "size", n, "limit", maxSourceBytes)
+		return respondErrorDetail(c, http.StatusRequestEntityTooLarge, codeSourceTooLarge, "Source file too large",
+			fmt.Sprintf("remote document has %d bytes (maximum %d)", n, maxSourceBytes))
+	}
+
+	outputPath := uniqueOutputPath(workDir, "output", format)
+	opts.MediaDir = filepath.Join(workDir, "media")
+	filename := "converted" + format.Extension
+	if base := path.Base(u.Path); base != "/" && base != "." {
+		filename = outputFilename(base, format)
+	}
+	if customName != "" {
+		filename = withExtension(customName, format.Extension)
+	}
+	logger = logger.With("size", n, "from", opts.From, "format", format.Writer)
+
+	warnings, err := s.convertToDOCX(c.Request().Context(), logger, []string{srcFile}, outputPath, opts)
+	if err != nil {
+		logger.Error("Erro na conversão", "error", err)
+		return respondConversionError(c, err)
+	}
+	logger.Info("Conversão concluída com sucesso")
+
+	setWarningsHeader(c, warnings)
+	return sendOutput(c, outputPath, filename, format.ContentType)
+}
+
+// errRemoteTooLarge indica que o documento remoto excede MAX_UPLOAD_BYTES
+var errRemoteTooLarge = errors.New("documento remoto excede o limite de upload")
+
+// downloadRemote baixa a URL em dest, limitado a maxUploadBytes, e retorna quantos bytes foram gravados
+func downloadRemote(ctx context.Context, logger *slog.Logger, u *url.URL, dest string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("o servidor remoto respondeu %s", resp.Status)
+	}
+	if resp.ContentLength > maxUploadBytes {
+		return 0, errRemoteTooLarge
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	// Ler um byte além do limite para detectar respostas maiores sem Content-Length
+	n, err := io.Copy(out, io.LimitReader(resp.Body, maxUploadBytes+1))
+	if err != nil {
+		return n, err
+	}
+	if n > maxUploadBytes {
+		return n, errRemoteTooLarge
+	}
+	logger.Info("Documento remoto baixado", "bytes", n, "content_type", resp.Header.Get(echo.HeaderContentType))
+	return n, nil
+}
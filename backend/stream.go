@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// streamConversion executa o pandoc escrevendo em stdout e envia a saída diretamente
+// na resposta, sem gravar o arquivo convertido em disco.
+//
+// Erros que acontecem antes do primeiro byte ser produzido são retornados para que o
+// handler responda normalmente. Depois que a resposta começou a ser enviada, as falhas
+// só podem ser registradas no log.
+func (s *server) streamConversion(c echo.Context, logger *slog.Logger, mdFiles []string, opts converter.Options, filename string) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	release, err := acquireConversionSlot()
+	if err != nil {
+		conversionsTotal.WithLabelValues(opts.Format.Writer, conversionStatus(err)).Inc()
+		return err
+	}
+	defer release()
+
+	_, span := startSpan(c.Request().Context(), "pandoc-convert", attribute.String("format", opts.Format.Writer),
+		attribute.String("from", opts.From), attribute.Int("files", len(mdFiles)), attribute.Bool("stream", true))
+	instrument := instrumentConversion(opts.Format.Writer)
+	finish := func(err error) {
+		instrument(err)
+		endSpan(span, err)
+	}
+
+	// O pandoc é encerrado no shutdown, no PANDOC_TIMEOUT ou quando a requisição termina (REQUEST_TIMEOUT
+	// ou cliente desconectado), antes que o diretório de trabalho seja removido
+	pandoc := s.pandoc()
+	ctx, cancel := pandoc.WithTimeout(conversionCtx)
+	defer cancel()
+	stop := context.AfterFunc(c.Request().Context(), cancel)
+	defer stop()
+
+	// O pandoc escreve no pipe em segundo plano enquanto a resposta lê do outro lado
+	pr, pw := io.Pipe()
+	var stderr bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		err := pandoc.Run(ctx, mdFiles, pandoc.Args(mdFiles, "-", opts), pw, &stderr)
+		pw.Close()
+		done <- err
+	}()
+
+	// Aguardar o primeiro byte: se o pandoc falhar antes disso ainda dá tempo de responder com erro
+	reader := bufio.NewReader(pr)
+	_, peekErr := reader.Peek(1)
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	if peekErr != nil {
+		// O pandoc terminou sem produzir saída
+		if err := <-done; err != nil {
+			err = pandoc.Error(ctx, err, stderr.Bytes())
+			finish(err)
+			c.Response().Header().Del(echo.HeaderContentDisposition)
+			return err
+		}
+		finish(nil)
+		setPandocVersionHeader(c)
+		return c.Blob(http.StatusOK, opts.Format.ContentType, nil)
+	}
+
+	setPandocVersionHeader(c)
+	if err := c.Stream(http.StatusOK, opts.Format.ContentType, reader); err != nil {
+		// O cliente desconectou; encerrar o pandoc e liberar quem ainda escreve no pipe
+		logger.Warn("Erro ao enviar saída do pandoc", "error", err)
+		cancel()
+		pr.CloseWithError(err)
+	}
+
+	err = <-done
+	logger.Info("Pandoc finalizado", "exit_code", converter.ExitCode(err))
+	if err != nil {
+		err = pandoc.Error(ctx, err, stderr.Bytes())
+	}
+	finish(err)
+
+	if err != nil {
+		logger.Error("Pandoc falhou durante o streaming", "error", err)
+	} else if warnings := converter.Warnings(stderr.String()); len(warnings) > 0 {
+		logger.Warn("Avisos do pandoc", "warnings", warnings)
+	}
+	return nil
+}
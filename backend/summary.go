@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// conversionSummary resume o que foi processado em uma conversão, para auditoria e para
+// investigar saídas inesperadamente pequenas
+type conversionSummary struct {
+	ArchiveEntries int      `json:"archive_entries,omitempty"` // arquivos extraídos do zip ou tar.gz
+	SourceFiles    []string `json:"source_files"`              // arquivos de origem convertidos, relativos ao arquivo compactado
+	SourceBytes    int64    `json:"source_bytes"`              // tamanho somado dos arquivos de origem
+	OutputBytes    int64    `json:"output_bytes,omitempty"`    // tamanho do arquivo gerado
+	MissingImages  []string `json:"missing_images,omitempty"`  // imagens referenciadas que não foram enviadas
+}
+
+// newConversionSummary monta o resumo da entrada a partir do arquivo recebido
+func newConversionSummary(upload *sourceUpload) *conversionSummary {
+	summary := &conversionSummary{ArchiveEntries: upload.Entries}
+	if upload.ExtractPath != "" {
+		summary.SourceFiles = sourcePaths(upload.ExtractPath, upload.Files)
+	} else {
+		summary.SourceFiles = []string{upload.Name}
+	}
+	for _, file := range upload.Files {
+		if info, err := os.Stat(file); err == nil {
+			summary.SourceBytes += info.Size()
+		}
+	}
+	// Só markdown e HTML têm as referências a imagens reconhecidas por converter.MissingImages
+	if upload.From.Reader == "markdown" || upload.From.Reader == "html" {
+		if missing, err := converter.MissingImages(upload.WorkDir, upload.Files); err == nil {
+			summary.MissingImages = missing
+		}
+	}
+	return summary
+}
+
+// withOutput retorna uma cópia do resumo com o tamanho do arquivo gerado em path
+func (s conversionSummary) withOutput(path string) *conversionSummary {
+	if info, err := os.Stat(path); err == nil {
+		s.OutputBytes = info.Size()
+	}
+	return &s
+}
+
+// setSummaryHeaders envia o resumo da conversão nos cabeçalhos X-Archive-Entries,
+// X-Source-File, X-Source-Bytes, X-Output-Bytes e X-Missing-Images. X-Source-File mostra qual
+// arquivo do zip foi escolhido, o que ajuda a perceber quando não era o esperado, e
+// X-Missing-Images aponta um upload incompleto antes que o documento seja aberto
+func setSummaryHeaders(c echo.Context, summary *conversionSummary) {
+	header := c.Response().Header()
+	if summary.ArchiveEntries > 0 {
+		header.Set("X-Archive-Entries", strconv.Itoa(summary.ArchiveEntries))
+	}
+	header.Set("X-Source-File", strings.Join(summary.SourceFiles, ", "))
+	header.Set("X-Source-Bytes", strconv.FormatInt(summary.SourceBytes, 10))
+	if summary.OutputBytes > 0 {
+		header.Set("X-Output-Bytes", strconv.FormatInt(summary.OutputBytes, 10))
+	}
+	if len(summary.MissingImages) > 0 {
+		value := strings.Join(summary.MissingImages, ", ")
+		if len(value) > maxWarningsHeaderLen {
+			value = value[:maxWarningsHeaderLen] + "..."
+		}
+		header.Set("X-Missing-Images", value)
+	}
+}
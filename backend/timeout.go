@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Tempo máximo padrão de uma requisição de conversão (upload, extração, conversão e envio),
+// configurável via REQUEST_TIMEOUT. Zero desativa o limite
+const defaultRequestTimeout = 120 * time.Second
+
+// Folga dada à escrita da resposta depois do prazo, para que o erro de timeout chegue ao cliente
+const requestTimeoutGrace = 5 * time.Second
+
+var requestTimeout = defaultRequestTimeout
+
+// requestTimeoutMiddleware limita a duração total das rotas de conversão. O contexto da
+// requisição expira no prazo, o que encerra o pandoc (veja convertToDOCX), e a conexão recebe
+// prazos de leitura e escrita, para que um cliente lento no upload ou no download não a prenda.
+// Os jobs assíncronos ficam de fora: eles usam um contexto sem cancelamento e só o upload e a
+// resposta 202 contam para o prazo
+func requestTimeoutMiddleware(timeout time.Duration) echo.MiddlewareFunc {
+	contextTimeout := middleware.ContextTimeoutWithConfig(middleware.ContextTimeoutConfig{
+		Timeout: timeout,
+		ErrorHandler: func(err error, c echo.Context) error {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return respondRequestTimeout(c)
+			}
+			return err
+		},
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		handler := contextTimeout(next)
+		return func(c echo.Context) error {
+			// Nem todo ResponseWriter aceita prazos (como o dos testes); o limite do contexto continua valendo
+			deadline := time.Now().Add(timeout)
+			rc := http.NewResponseController(c.Response().Writer)
+			_ = rc.SetReadDeadline(deadline)
+			_ = rc.SetWriteDeadline(deadline.Add(requestTimeoutGrace))
+			return handler(c)
+		}
+	}
+}
+
+// requestTimedOut indica se a requisição excedeu REQUEST_TIMEOUT
+func requestTimedOut(c echo.Context) bool {
+	return errors.Is(c.Request().Context().Err(), context.DeadlineExceeded)
+}
+
+// respondRequestTimeout responde 504 a uma requisição que excedeu REQUEST_TIMEOUT
+func respondRequestTimeout(c echo.Context) error {
+	return respondError(c, http.StatusGatewayTimeout, codeRequestTimeout, "Request timed out after "+requestTimeout.String())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Nome do serviço nos traces quando OTEL_SERVICE_NAME não é definido
+const defaultServiceName = "markdown-converter"
+
+// Tracer dos spans de cada etapa da conversão. Enquanto setupTracing não configura um provider,
+// os spans são descartados
+var tracer = otel.Tracer("github.com/douglastaylorb/convert-markdown-to-docx")
+
+// shutdownTracing envia os spans pendentes e encerra o exportador; chamada no shutdown do servidor
+var shutdownTracing = func(context.Context) error { return nil }
+
+// setupTracing exporta os traces via OTLP/HTTP quando OTEL_EXPORTER_OTLP_ENDPOINT ou
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT está definido. O endpoint, os cabeçalhos, o protocolo e o
+// nome do serviço vêm das variáveis OTEL_* padrão, lidas pelo próprio SDK
+func setupTracing(ctx context.Context) error {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		slog.Info("Tracing desativado: OTEL_EXPORTER_OTLP_ENDPOINT não definido")
+		return nil
+	}
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		slog.Info("Tracing desativado por OTEL_SDK_DISABLED")
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return err
+	}
+	// OTEL_SERVICE_NAME e OTEL_RESOURCE_ATTRIBUTES, lidos por último, sobrescrevem o nome padrão
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(defaultServiceName), semconv.ServiceVersion(buildVersion)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil && !errors.Is(err, resource.ErrPartialResource) {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	shutdownTracing = provider.Shutdown
+	slog.Info("Tracing OTLP ativado")
+	return nil
+}
+
+// tracingMiddleware cria o span de cada requisição, continuando o trace recebido em traceparent.
+// /health, /metrics e /version ficam de fora para não encher os traces com verificações periódicas
+func tracingMiddleware() echo.MiddlewareFunc {
+	return otelecho.Middleware(defaultServiceName, otelecho.WithSkipper(func(c echo.Context) bool {
+		path := c.Path()
+		return path == "/health" || path == "/metrics" || path == "/version" || middleware.DefaultSkipper(c)
+	}))
+}
+
+// startSpan inicia o span de uma etapa da conversão como filho do span em ctx
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan registra no span o erro da etapa, se houver, e o encerra
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Campo do formulário com o arquivo a converter, configurável via UPLOAD_FIELD. O campo "file"
+// continua aceito quando outro nome é configurado
+var uploadField = "file"
+
+// Quanto de um formulário multipart fica em memória, padrão de MULTIPART_MEMORY_BYTES. Acima
+// disso os arquivos enviados são gravados em arquivos temporários (em TMPDIR), que o net/http
+// remove ao fim da requisição. O padrão do net/http, 32MB por requisição, pesaria com vários
+// uploads grandes ao mesmo tempo
+const defaultMultipartMemory = 8 << 20
+
+var multipartMemory int64 = defaultMultipartMemory
+
+// parseMultipartForm lê o formulário multipart com o limite de memória multipartMemory antes do
+// handler, já que o primeiro c.FormValue ou c.FormFile usaria o limite padrão do net/http.
+// Corpos que não são multipart seguem para o handler, que responde com o erro adequado
+func parseMultipartForm(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := c.Request().ParseMultipartForm(multipartMemory)
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) {
+			// Corpo maior que MAX_UPLOAD_BYTES, detectado pelo bodyLimit durante a leitura
+			return httpErr
+		}
+		return next(c)
+	}
+}
+
+// Campos de arquivo do formulário com outros usos, ignorados ao procurar o arquivo a converter
+var auxiliaryFileFields = []string{"reference"}
+
+// sourceUpload é o arquivo enviado no campo "file" depois de salvo (e extraído, se for um zip)
+// no diretório de trabalho da requisição
+type sourceUpload struct {
+	Name        string                // nome do arquivo enviado, já higienizado
+	IsArchive   bool                  // o arquivo enviado é um zip ou tar.gz
+	WorkDir     string                // diretório de trabalho da requisição
+	ExtractPath string                // diretório com o conteúdo extraído; vazio para um documento enviado diretamente
+	Main        string                // arquivo de origem escolhido com ?main=, relativo à raiz do arquivo compactado
+	Entries     int                   // arquivos extraídos do arquivo compactado
+	Files       []string              // arquivos de origem a converter
+	From        converter.InputFormat // formato de entrada dos arquivos de origem
+	Cleanup     func()                // remove o diretório de trabalho
+}
+
+// receiveUpload valida e salva o arquivo enviado em um diretório de trabalho novo. Para um zip ou tar.gz,
+// extrai o conteúdo e localiza o arquivo de origem (ou todos eles, se all for verdadeiro).
+// O diretório é removido quando ctx termina (veja createWorkspace). Os arquivos de origem são
+// convertidos para UTF-8, a menos que a requisição envie ?detect_encoding=false.
+// Em caso de falha o diretório já foi removido e o erro é um *APIError pronto para a resposta.
+func receiveUpload(ctx context.Context, c echo.Context, logger *slog.Logger, from converter.InputFormat, all bool) (*sourceUpload, error) {
+	detectEncoding, err := queryBoolDefault(c, "detect_encoding", true)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidParameter, "Invalid value for detect_encoding: "+c.QueryParam("detect_encoding"), "")
+	}
+
+	// Obter o arquivo do formulário
+	file, err := formUpload(c)
+	if err != nil {
+		logger.Warn("Erro ao obter arquivo", "error", err)
+		if requestTimedOut(c) {
+			return nil, newAPIError(http.StatusGatewayTimeout, codeRequestTimeout, "Request timed out after "+requestTimeout.String(), "")
+		}
+		return nil, newAPIError(http.StatusBadRequest, codeNoFile, "No file uploaded: send the file in the form field "+strconv.Quote(uploadField), err.Error())
+	}
+	logger = logger.With("upload", file.Filename)
+	logger.Info("Arquivo recebido", "size", file.Size)
+
+	// O nome vem do cliente, então só o nome base higienizado é usado no disco
+	uploadName, err := sanitizeFilename(file.Filename)
+	if err != nil {
+		logger.Warn("Nome de arquivo inválido", "error", err)
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidFilename, "Invalid file name", err.Error())
+	}
+
+	if file.Size > maxUploadBytes {
+		logger.Warn("Arquivo excede o limite de upload", "size", file.Size, "limit", maxUploadBytes)
+		return nil, newAPIError(http.StatusRequestEntityTooLarge, codeFileTooLarge, "File too large", "")
+	}
+
+	// Aceitar um arquivo compactado ou um documento enviado diretamente. Com ?from= o documento
+	// pode ter qualquer extensão; sem ele, a extensão precisa identificar o formato
+	upload := &sourceUpload{Name: uploadName, IsArchive: converter.IsArchiveName(uploadName), From: from, Main: c.QueryParam("main")}
+	sourceFormats := converter.InputFormats
+	if from.Reader != "" {
+		sourceFormats = []converter.InputFormat{from}
+	} else if !upload.IsArchive {
+		if _, ok := converter.InputFormatForFile(uploadName, converter.InputFormats); !ok {
+			logger.Warn("Tipo de arquivo não suportado")
+			return nil, newAPIError(http.StatusBadRequest, codeUnsupportedFile,
+				"Unsupported file type: upload a .zip or .tar.gz archive or a document with one of the extensions "+strings.Join(converter.InputExtensions(converter.InputFormats), ", "), "")
+		}
+	}
+
+	// Com ?main= o cliente escolhe o arquivo de origem dentro do zip, em vez do primeiro encontrado
+	if upload.Main != "" && (!upload.IsArchive || all) {
+		return nil, newAPIError(http.StatusBadRequest, codeInvalidParameter, "main is only supported for an archive upload with mode=single", "")
+	}
+
+	// Cada requisição recebe um diretório de trabalho isolado
+	upload.WorkDir, upload.Cleanup, err = createWorkspace(ctx, logger)
+	if err != nil {
+		logger.Error("Erro ao criar diretório de trabalho", "error", err)
+		return nil, newAPIError(http.StatusInternalServerError, codeStorageFailed, "Failed to create working directory", "")
+	}
+	if err := upload.extract(ctx, logger, file, sourceFormats, all); err != nil {
+		upload.Cleanup()
+		return nil, err
+	}
+	if detectEncoding {
+		if err := upload.normalizeEncoding(logger); err != nil {
+			upload.Cleanup()
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// formUpload obtém o arquivo enviado no campo uploadField ou em "file". Sem nenhum dos dois,
+// aceita o único campo de arquivo do formulário que não seja um campo auxiliar
+func formUpload(c echo.Context) (*multipart.FileHeader, error) {
+	for _, field := range []string{uploadField, "file"} {
+		if file, err := c.FormFile(field); err == nil {
+			return file, nil
+		}
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	for field, files := range form.File {
+		if len(files) > 0 && !slices.Contains(auxiliaryFileFields, field) {
+			fields = append(fields, field)
+		}
+	}
+	switch len(fields) {
+	case 0:
+		return nil, errors.New("no file part in the form")
+	case 1:
+		return form.File[fields[0]][0], nil
+	}
+	slices.Sort(fields)
+	return nil, fmt.Errorf("several file fields in the form: %s", strings.Join(fields, ", "))
+}
+
+// normalizeEncoding converte para UTF-8 os arquivos de origem escritos em outra codificação
+// (UTF-16, Latin-1) e remove o BOM, já que o pandoc só lê UTF-8. Formatos binários, como docx,
+// ficam como estão
+func (u *sourceUpload) normalizeEncoding(logger *slog.Logger) error {
+	if u.From.Binary {
+		return nil
+	}
+	for _, file := range u.Files {
+		encoding, converted, err := converter.NormalizeEncoding(file)
+		if err != nil {
+			logger.Warn("Erro ao converter arquivo de origem para UTF-8", "file", file, "encoding", encoding, "error", err)
+			return newAPIError(http.StatusBadRequest, codeInvalidEncoding, "Failed to convert source file to UTF-8", err.Error())
+		}
+		if converted {
+			logger.Info("Arquivo de origem convertido para UTF-8", "file", file, "encoding", encoding)
+		}
+	}
+	return nil
+}
+
+// extract salva o arquivo enviado no diretório de trabalho e localiza os arquivos de origem.
+// Cada etapa (save, unzip, find-markdown) gera um span filho do span em ctx
+func (u *sourceUpload) extract(ctx context.Context, logger *slog.Logger, file *multipart.FileHeader, sourceFormats []converter.InputFormat, all bool) error {
+	uploadPath := filepath.Join(u.WorkDir, u.Name)
+	_, span := startSpan(ctx, "save", attribute.String("upload.name", u.Name), attribute.Int64("upload.bytes", file.Size))
+	err := converter.SaveUploadedFile(file, uploadPath)
+	endSpan(span, err)
+	if err != nil {
+		logger.Error("Erro ao salvar arquivo", "error", err)
+		return newAPIError(http.StatusInternalServerError, codeStorageFailed, "Failed to save file", "")
+	}
+
+	if !u.IsArchive {
+		// Documento enviado diretamente, não há nada para extrair
+		u.Files = []string{uploadPath}
+		if u.From.Reader == "" {
+			u.From, _ = converter.InputFormatForFile(u.Name, converter.InputFormats)
+		}
+		return u.checkSourceSizes(logger)
+	}
+
+	// Extrair o zip ou tar.gz, identificado pela assinatura do conteúdo
+	u.ExtractPath = filepath.Join(u.WorkDir, "extracted")
+	_, span = startSpan(ctx, "unzip", attribute.Int64("upload.bytes", file.Size))
+	entries, err := converter.ExtractArchive(logger, uploadPath, u.ExtractPath, extractLimits)
+	span.SetAttributes(attribute.Int("archive.entries", entries))
+	endSpan(span, err)
+	if err != nil {
+		logger.Warn("Erro ao extrair arquivo compactado", "error", err)
+		switch {
+		case errors.Is(err, converter.ErrNotAnArchive):
+			return newAPIError(http.StatusBadRequest, codeNotAZip, "Uploaded file is not a valid zip or tar.gz archive", "")
+		case errors.Is(err, converter.ErrEmptyArchive):
+			return newAPIError(http.StatusBadRequest, codeEmptyArchive, "Uploaded archive is empty", "")
+		case errors.Is(err, converter.ErrConflictingEntry):
+			return newAPIError(http.StatusBadRequest, codeInvalidArchive, "Archive contains conflicting entries", err.Error())
+		case errors.Is(err, converter.ErrEncryptedArchive):
+			return newAPIError(http.StatusBadRequest, codeEncryptedArchive, "Password-protected archives are not supported", err.Error())
+		case errors.Is(err, converter.ErrArchiveLimit):
+			return newAPIError(http.StatusBadRequest, codeArchiveTooLarge, "Failed to extract archive", err.Error())
+		}
+		return newAPIError(http.StatusInternalServerError, codeExtractFailed, "Failed to extract archive", err.Error())
+	}
+	u.Entries = entries
+
+	// Encontrar o(s) arquivo(s) de origem
+	_, span = startSpan(ctx, "find-markdown", attribute.Bool("all", all))
+	if u.Main != "" {
+		var srcFile string
+		srcFile, u.From, err = converter.FindMainFile(u.ExtractPath, u.Main, sourceFormats)
+		u.Files = []string{srcFile}
+	} else if all {
+		u.Files, u.From, err = converter.FindSourceFiles(u.ExtractPath, sourceFormats)
+	} else {
+		var srcFile string
+		srcFile, u.From, err = converter.FindSourceFile(u.ExtractPath, sourceFormats)
+		u.Files = []string{srcFile}
+	}
+	span.SetAttributes(attribute.Int("source.files", len(u.Files)), attribute.String("from", u.From.Reader))
+	endSpan(span, err)
+	if err != nil {
+		logger.Warn("Erro ao encontrar arquivo de origem", "error", err)
+		if errors.Is(err, converter.ErrMainFileNotFound) {
+			return newAPIError(http.StatusNotFound, codeMainFileNotFound, "File not found in archive: "+u.Main, "")
+		}
+		return newAPIError(http.StatusBadRequest, codeMarkdownNotFound, err.Error(), "")
+	}
+	return u.checkSourceSizes(logger)
+}
+
+// checkSourceSizes rejeita arquivos de origem maiores que maxSourceBytes. Complementa o limite
+// de extração, que vale para o conteúdo inteiro do arquivo compactado
+func (u *sourceUpload) checkSourceSizes(logger *slog.Logger) error {
+	for _, file := range u.Files {
+		info, err := os.Stat(file)
+		if err != nil {
+			logger.Error("Erro ao verificar arquivo de origem", "file", file, "error", err)
+			return newAPIError(http.StatusInternalServerError, codeExtractFailed, "Failed to read source file", "")
+		}
+		if info.Size() > maxSourceBytes {
+			name := filepath.Base(file)
+			if u.ExtractPath != "" {
+				name = sourcePaths(u.ExtractPath, []string{file})[0]
+			}
+			logger.Warn("Arquivo de origem excede o limite", "file", name, "size", info.Size(), "limit", maxSourceBytes)
+			return newAPIError(http.StatusRequestEntityTooLarge, codeSourceTooLarge, "Source file too large",
+				fmt.Sprintf("%s has %d bytes (maximum %d)", name, info.Size(), maxSourceBytes))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/douglastaylorb/convert-markdown-to-docx/converter"
+	"github.com/labstack/echo/v4"
+)
+
+// validationResult é a resposta de /validate
+type validationResult struct {
+	Valid    bool     `json:"valid"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// handleValidate confere se o arquivo enviado é lido pelo pandoc sem erros, sem gerar
+// nenhum documento. Responde 200 com {"valid": true} ou 422 com o erro do pandoc, para
+// que pipelines de CI falhem antes da conversão de verdade
+func (s *server) handleValidate(c echo.Context) error {
+	logger := requestLogger(c)
+	logger.Info("Iniciando validação")
+
+	from, err := inputFormatParam(c)
+	if err != nil {
+		logger.Warn("Formato de entrada não suportado", "from", c.QueryParam("from"))
+		return respondError(c, http.StatusBadRequest, codeInvalidInputFormat, err.Error())
+	}
+
+	// Com ?mode=merge ou ?mode=batch todos os arquivos de origem do zip são validados
+	mode, err := conversionModeParam(c)
+	if err != nil {
+		return respondError(c, http.StatusBadRequest, codeInvalidParameter, err.Error())
+	}
+
+	upload, err := receiveUpload(c.Request().Context(), c, logger, from, mode != modeSingle)
+	if err != nil {
+		return respondAPIError(c, err)
+	}
+	defer upload.Cleanup()
+	logger = logger.With("upload", upload.Name, "source", sourcePaths(upload.WorkDir, upload.Files), "from", upload.From.Reader)
+
+	result, err := s.validateSources(upload.Files, upload.From.Reader)
+	if err != nil {
+		logger.Error("Erro na validação", "error", err)
+		return respondConversionError(c, err)
+	}
+
+	if !result.Valid {
+		logger.Info("Validação falhou", "error", result.Error)
+		return c.JSON(http.StatusUnprocessableEntity, result)
+	}
+	logger.Info("Validação concluída", "warnings", len(result.Warnings))
+	return c.JSON(http.StatusOK, result)
+}
+
+// validateSources lê os arquivos com o pandoc usando o writer native e descartando a saída.
+// Falhas do pandoc viram um resultado inválido; o erro retornado é reservado para falta de
+// vaga, tempo limite ou falha ao iniciar o processo
+func (s *server) validateSources(srcFiles []string, reader string) (validationResult, error) {
+	release, err := acquireConversionSlot()
+	if err != nil {
+		return validationResult{}, err
+	}
+	defer release()
+
+	pandoc := s.pandoc()
+	ctx, cancel := pandoc.WithTimeout(conversionCtx)
+	defer cancel()
+
+	args := append([]string{"--from=" + reader, "--to=native", "-o", os.DevNull}, srcFiles...)
+	var stderr bytes.Buffer
+	err = pandoc.Run(ctx, srcFiles, args, io.Discard, &stderr)
+	warnings := converter.Warnings(stderr.String())
+	if err == nil {
+		return validationResult{Valid: true, Warnings: warnings}, nil
+	}
+
+	if converter.ExitCode(err) <= 0 || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return validationResult{}, pandoc.Error(ctx, err, stderr.Bytes())
+	}
+	result := validationResult{Error: strings.Join(warnings, "\n")}
+	if result.Error == "" {
+		result.Error = err.Error()
+	}
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Idade padrão a partir da qual sobras em uploadsDir são consideradas órfãs
+const defaultStaleUploadAge = time.Hour
+
+// Intervalo padrão entre as varreduras de sobras em uploadsDir
+const defaultStaleUploadSweepInterval = 10 * time.Minute
+
+// Com KEEP_TEMP=true os diretórios de trabalho são mantidos ao final de cada requisição, para
+// inspecionar os arquivos intermediários. A varredura de sobras os remove depois de STALE_UPLOAD_AGE
+var keepTemp bool
+
+// Diretórios de trabalho ainda não removidos, para que o encerramento do servidor possa limpá-los
+var (
+	workspacesMu     sync.Mutex
+	activeWorkspaces = make(map[string]struct{})
+)
+
+// createWorkspace cria um diretório de trabalho isolado dentro de uploadsDir e
+// retorna a função que o remove. O caminho é absoluto, como uploadsDir, pois o pandoc
+// roda com o diretório dos arquivos de origem como diretório atual.
+// O diretório também é removido quando ctx termina, para que um cliente que se desconecta no
+// meio da requisição não deixe sobras; quem precisa do diretório além da requisição (um job
+// assíncrono) deve passar um contexto sem cancelamento. A função retornada pode ser chamada mais de uma vez
+func createWorkspace(ctx context.Context, logger *slog.Logger) (string, func(), error) {
+	workDir, err := os.MkdirTemp(uploadsDir, "convert-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	workspacesMu.Lock()
+	activeWorkspaces[workDir] = struct{}{}
+	workspacesMu.Unlock()
+
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			workspacesMu.Lock()
+			delete(activeWorkspaces, workDir)
+			workspacesMu.Unlock()
+
+			// Fora de activeWorkspaces, o diretório mantido fica a cargo de sweepStaleUploads
+			if keepTemp {
+				logger.Info("Diretório de trabalho mantido (KEEP_TEMP)", "dir", workDir)
+				return
+			}
+			if err := os.RemoveAll(workDir); err != nil {
+				logger.Error("Erro ao remover diretório de trabalho", "dir", workDir, "error", err)
+				return
+			}
+			logger.Info("Diretório de trabalho removido", "dir", workDir)
+		})
+	}
+	context.AfterFunc(ctx, cleanup)
+	return workDir, cleanup, nil
+}
+
+// isActiveWorkspace indica se path é um diretório de trabalho ainda em uso
+func isActiveWorkspace(path string) bool {
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+	_, ok := activeWorkspaces[path]
+	return ok
+}
+
+// removeActiveWorkspaces remove todos os diretórios de trabalho que ainda existem
+func removeActiveWorkspaces() {
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+
+	for workDir := range activeWorkspaces {
+		if err := os.RemoveAll(workDir); err != nil {
+			slog.Error("Erro ao remover diretório de trabalho", "dir", workDir, "error", err)
+		}
+		delete(activeWorkspaces, workDir)
+	}
+}
+
+// removeStaleUploads apaga de dir as entradas modificadas há mais de maxAge, deixadas para
+// trás por execuções anteriores que terminaram no meio de uma conversão. Diretórios de trabalho
+// em uso e o cache de conversões são preservados. Retorna quantas foram removidas.
+func removeStaleUploads(dir string, maxAge time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	cutoff := time.Now().Add(-maxAge)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if isActiveWorkspace(path) || (conversionCache != nil && path == conversionCache.dir) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			slog.Error("Erro ao remover upload órfão", "path", path, "error", err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// sweepStaleUploads roda removeStaleUploads periodicamente, como rede de segurança para
+// diretórios que escaparam da limpeza de suas requisições
+func sweepStaleUploads(interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		removed, err := removeStaleUploads(uploadsDir, maxAge)
+		if err != nil {
+			slog.Error("Erro ao limpar uploads órfãos", "error", err)
+		} else if removed > 0 {
+			slog.Warn("Uploads órfãos removidos", "count", removed, "older_than", maxAge.String())
+		}
+	}
+}